@@ -0,0 +1,313 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	archiveFile       = "lookups.jsonl"
+	archivePrefix     = "lookups-"
+	archiveTimeFormat = "20060102T150405.000Z"
+)
+
+var ErrUnsupportedCompression = errors.New("unsupported compression")
+
+// ArchiveOptions control the rotation and cleanup of an archive.  Zero values
+// disable the corresponding limit.
+type ArchiveOptions struct {
+	// MaxBytes rotates the current file once it holds this many bytes.
+	MaxBytes int64
+	// Interval rotates the current file once it has been open this long.
+	Interval time.Duration
+	// Compression is applied to rotated files: "gzip", "zstd", or "" for
+	// none.
+	Compression string
+	// MaxFiles is the number of rotated files to keep.
+	MaxFiles int
+	// MaxAge deletes rotated files last written longer ago than this.
+	MaxAge time.Duration
+}
+
+// DefaultArchiveOptions rotate the archive daily or at 64MB, and gzip the
+// rotated files.
+var DefaultArchiveOptions = ArchiveOptions{MaxBytes: 64 << 20, Interval: 24 * time.Hour, Compression: "gzip"}
+
+// NewArchiveStore returns a Store appending every lookup it accepts, as a
+// line of JSON with the name of its client, to lookups.jsonl in dir.  The
+// file is rotated to lookups-<time>.jsonl according to opts, and compressed
+// in the background.
+func NewArchiveStore(dir string, opts ArchiveOptions) (Store, error) {
+	switch opts.Compression {
+	case "", "gzip", "zstd":
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedCompression, "%q", opts.Compression)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating archive directory")
+	}
+	return &archiveStore{dir: dir, opts: opts}, nil
+}
+
+type archiveStore struct {
+	dir  string
+	opts ArchiveOptions
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	// jobs serializes the compression and cleanup of rotated files, which
+	// run in the background, and pending lets Close wait for them.
+	jobs    sync.Mutex
+	pending sync.WaitGroup
+}
+
+// archiveEntry is a line of the archive, and the body of a forwarded
+// message.
+type archiveEntry struct {
+	Lookup
+	ClientName string `json:"client_name,omitempty"`
+}
+
+func (s *archiveStore) Accept(_ context.Context, batch Batch) error {
+	names := batch.clientNames()
+	var lines []byte
+	for _, lookup := range batch.Lookups {
+		line, err := json.Marshal(archiveEntry{Lookup: lookup, ClientName: names[lookup.Client]})
+		if err != nil {
+			return errors.Wrap(err, "marshaling archive entry")
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.due(time.Now()) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	n, err := s.f.Write(lines)
+	s.size += int64(n)
+	return errors.Wrap(err, "writing archive")
+}
+
+func (s *archiveStore) Close() error {
+	s.mu.Lock()
+	err := s.close()
+	s.mu.Unlock()
+
+	s.pending.Wait()
+	return err
+}
+
+func (s *archiveStore) open() error {
+	if s.f != nil {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, archiveFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening archive")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "checking archive")
+	}
+	s.f, s.size, s.opened = f, info.Size(), time.Now()
+	if s.size > 0 {
+		s.opened = s.started()
+	}
+	return nil
+}
+
+// started returns when the current file was started, so that a restart
+// does not reset its rotation interval: when the file before it was
+// rotated, or else when its first lookup was made.
+func (s *archiveStore) started() time.Time {
+	if rotated, err := s.rotated(); err == nil && len(rotated) > 0 {
+		name := strings.TrimPrefix(filepath.Base(rotated[0]), archivePrefix)
+		if at, err := time.Parse(archiveTimeFormat, strings.SplitN(name, ".jsonl", 2)[0]); err == nil {
+			return at
+		}
+	}
+	f, err := os.Open(filepath.Join(s.dir, archiveFile))
+	if err != nil {
+		return time.Now()
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	entry := archiveEntry{}
+	if err != nil || json.Unmarshal(line, &entry) != nil || entry.When.IsZero() {
+		return time.Now()
+	}
+	return entry.When
+}
+
+func (s *archiveStore) close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return errors.Wrap(err, "closing archive")
+}
+
+// due says whether the current file should be rotated before writing to it.
+func (s *archiveStore) due(now time.Time) bool {
+	if s.f == nil || s.size == 0 {
+		return false
+	}
+	return s.opts.MaxBytes > 0 && s.size >= s.opts.MaxBytes ||
+		s.opts.Interval > 0 && now.Sub(s.opened) >= s.opts.Interval
+}
+
+// rotate closes and renames the current file, then compresses the rotated
+// files and applies the cleanup limits to them in the background, so that
+// batches are not held up meanwhile.
+func (s *archiveStore) rotate() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	rotated := filepath.Join(s.dir, archivePrefix+time.Now().UTC().Format(archiveTimeFormat)+".jsonl")
+	if err := os.Rename(filepath.Join(s.dir, archiveFile), rotated); err != nil {
+		return errors.Wrap(err, "rotating archive")
+	}
+	logger.Info("rotated archive", "store", "archive", "file", rotated, "bytes", s.size)
+
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		s.jobs.Lock()
+		defer s.jobs.Unlock()
+
+		if err := s.compress(); err != nil {
+			logger.Error("compressing archive", "store", "archive", "error", err)
+		}
+		if err := s.cleanup(time.Now()); err != nil {
+			logger.Error("cleaning up archives", "store", "archive", "error", err)
+		}
+	}()
+	return nil
+}
+
+// compress compresses the rotated files that are not yet, including any
+// left uncompressed by an earlier run.
+func (s *archiveStore) compress() error {
+	if s.opts.Compression == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, archivePrefix+"*.jsonl"))
+	if err != nil {
+		return errors.Wrap(err, "listing archives")
+	}
+	for _, path := range paths {
+		if err = compressFile(path, s.opts.Compression); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressFile replaces path with path.gz, or path.zst for zstd.
+func compressFile(path, compression string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening file to compress")
+	}
+	defer in.Close()
+
+	ext := ".gz"
+	if compression == "zstd" {
+		ext = ".zst"
+	}
+	tmp := path + ext + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "creating compressed file")
+	}
+	var zw io.WriteCloser
+	if compression == "zstd" {
+		zw, err = zstd.NewWriter(out)
+	} else {
+		zw = gzip.NewWriter(out)
+	}
+	if err == nil {
+		_, err = io.Copy(zw, in)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+ext)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return errors.Wrap(err, "compressing file")
+	}
+	return errors.Wrap(os.Remove(path), "removing uncompressed file")
+}
+
+// cleanup deletes the rotated files beyond MaxFiles or older than MaxAge.
+func (s *archiveStore) cleanup(now time.Time) error {
+	rotated, err := s.rotated()
+	if err != nil {
+		return err
+	}
+	for x, path := range rotated {
+		expired := s.opts.MaxFiles > 0 && x >= s.opts.MaxFiles
+		if !expired && s.opts.MaxAge > 0 {
+			info, err := os.Stat(path)
+			expired = err == nil && now.Sub(info.ModTime()) > s.opts.MaxAge
+		}
+		if !expired {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			return errors.Wrap(err, "removing archive")
+		}
+		logger.Info("removed archive", "store", "archive", "file", path)
+	}
+	return nil
+}
+
+// rotated returns the rotated files, newest first.
+func (s *archiveStore) rotated() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, archivePrefix+"*"))
+	if err != nil {
+		return nil, errors.Wrap(err, "listing archives")
+	}
+	var rotated []string
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".tmp") {
+			rotated = append(rotated, path)
+		}
+	}
+	// The names sort by rotation time.
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	return rotated, nil
+}
@@ -0,0 +1,61 @@
+package nsrecorder
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const content = "{\"host\":\"example.com\"}\n"
+	for _, tc := range []struct {
+		compression, ext string
+		open             func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip", ".gz", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"zstd", ".zst", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	} {
+		path := filepath.Join(dir, "lookups-"+tc.compression+".jsonl")
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = compressFile(path, tc.compression); err != nil {
+			t.Fatalf("%s: %v", tc.compression, err)
+		}
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: uncompressed file left: %v", tc.compression, err)
+		}
+		f, err := os.Open(path + tc.ext)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.compression, err)
+		}
+		r, err := tc.open(f)
+		if err != nil {
+			f.Close()
+			t.Fatalf("%s: %v", tc.compression, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.compression, err)
+		}
+		if string(got) != content {
+			t.Errorf("%s: decompressed %q, want %q", tc.compression, got, content)
+		}
+	}
+
+	if _, err = NewArchiveStore(dir, ArchiveOptions{Compression: "xz"}); err == nil {
+		t.Error("no error for xz compression")
+	}
+}
@@ -0,0 +1,195 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotPrefix     = "nsr-"
+	snapshotTimeFormat = "20060102T150405Z"
+	backupRetry        = 100 * time.Millisecond
+)
+
+// Backuper is implemented by stores that can write a consistent copy of
+// their data to a file while they are written to.
+type Backuper interface {
+	Backup(ctx context.Context, dest string) error
+}
+
+// SnapshotOptions control the snapshots written by Snapshot.
+type SnapshotOptions struct {
+	// Compression is applied to snapshots: "gzip", or "" for none.
+	Compression string
+	// Keep is the number of snapshots to keep, 0 keeps them all.
+	Keep int
+}
+
+// Snapshot backs b up to nsr-<time>.db in dir, compressed according to
+// opts, deletes the snapshots beyond opts.Keep, and returns the path of the
+// new snapshot.
+func Snapshot(ctx context.Context, b Backuper, dir string, opts SnapshotOptions) (string, error) {
+	switch opts.Compression {
+	case "", "gzip":
+	default:
+		return "", errors.Wrapf(ErrUnsupportedCompression, "%q", opts.Compression)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "creating backup directory")
+	}
+
+	path := filepath.Join(dir, snapshotPrefix+time.Now().UTC().Format(snapshotTimeFormat)+".db")
+	tmp := path + ".tmp"
+	if err := b.Backup(ctx, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", errors.Wrap(err, "renaming snapshot")
+	}
+	if opts.Compression == "gzip" {
+		if err := compressFile(path, opts.Compression); err != nil {
+			return "", err
+		}
+		path += ".gz"
+	}
+	return path, removeSnapshots(dir, opts.Keep)
+}
+
+// SnapshotEvery takes a snapshot of b in dir every interval until ctx is
+// done.  The first is taken once interval has passed since the newest
+// snapshot in dir, right away if there is none, so that restarts do not
+// postpone snapshots.
+func SnapshotEvery(ctx context.Context, b Backuper, dir string, opts SnapshotOptions, interval time.Duration) {
+	if interval <= 0 {
+		logger.Error("not backing up", "dir", dir, "error", errors.Errorf("invalid interval %s", interval))
+		return
+	}
+	next := time.Now()
+	if last, ok := lastSnapshot(dir); ok {
+		next = last.Add(interval)
+	}
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		start := time.Now()
+		next = start.Add(interval)
+		path, err := Snapshot(ctx, b, dir, opts)
+		if err != nil {
+			logger.Error("backing up", "dir", dir, "error", err)
+			continue
+		}
+		logger.Info("backed up", "file", path, "duration", time.Since(start))
+	}
+}
+
+// lastSnapshot returns the time of the newest snapshot in dir, if any.
+func lastSnapshot(dir string) (time.Time, bool) {
+	paths, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var last time.Time
+	for _, path := range paths {
+		if at, ok := snapshotTime(filepath.Base(path)); ok && at.After(last) {
+			last = at
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// snapshotTime returns the time a snapshot named name was taken, and
+// whether name is that of a snapshot: nsr-<time>.db, or nsr-<time>.db.gz.
+func snapshotTime(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, ".gz")
+	if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, ".db") {
+		return time.Time{}, false
+	}
+	at, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), ".db"))
+	return at, err == nil
+}
+
+// removeSnapshots deletes the snapshots in dir beyond the newest keep.
+// Files not named like a snapshot, such as partitions of a db kept in dir,
+// are left alone.
+func removeSnapshots(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"))
+	if err != nil {
+		return errors.Wrap(err, "listing snapshots")
+	}
+	var snapshots []string
+	taken := map[string]time.Time{}
+	for _, path := range paths {
+		if at, ok := snapshotTime(filepath.Base(path)); ok {
+			snapshots = append(snapshots, path)
+			taken[path] = at
+		}
+	}
+	// Newest first.
+	sort.SliceStable(snapshots, func(i, j int) bool { return taken[snapshots[i]].After(taken[snapshots[j]]) })
+	for x := keep; x < len(snapshots); x++ {
+		if err = os.Remove(snapshots[x]); err != nil {
+			return errors.Wrap(err, "removing snapshot")
+		}
+		logger.Info("removed snapshot", "file", snapshots[x])
+	}
+	return nil
+}
+
+// Backup copies the db to a new sqlite db at dest with the online backup
+// API, which reads a consistent state of the db without blocking writers in
+// WAL mode.
+func (s *sqliteStore) Backup(ctx context.Context, dest string) error {
+	if _, err := os.Stat(s.path); err != nil {
+		return errors.Wrap(err, "checking sqlite db")
+	}
+	_, driver := sqliteDriver(s.opts.Pragmas)
+	src, err := driver.Open(sqliteDSN(s.path, s.opts))
+	if err != nil {
+		return errors.Wrap(err, "opening sqlite3 db connection")
+	}
+	defer src.Close()
+	dst, err := (&sqlite3.SQLiteDriver{}).Open(dest)
+	if err != nil {
+		return errors.Wrap(err, "opening backup db connection")
+	}
+	defer dst.Close()
+
+	backup, err := dst.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return errors.Wrap(err, "starting backup")
+	}
+	for {
+		// Steps report a busy or locked db as not done, to be retried.
+		done, err := backup.Step(-1)
+		if err != nil {
+			_ = backup.Finish()
+			return errors.Wrap(err, "backing up")
+		}
+		if done {
+			break
+		}
+		select {
+		case <-time.After(backupRetry):
+		case <-ctx.Done():
+			_ = backup.Finish()
+			return errors.Wrap(ctx.Err(), "backing up")
+		}
+	}
+	return errors.Wrap(backup.Finish(), "finishing backup")
+}
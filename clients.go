@@ -0,0 +1,76 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// ClientSpan is a period during which a client IP resolved to a name.
+type ClientSpan struct {
+	IP        string    `json:"ip"`
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// ClientHistory is implemented by stores that record client name changes.
+type ClientHistory interface {
+	// ClientAt returns the span holding the name ip had at the given time:
+	// the latest span that started at or before it.
+	ClientAt(ip string, at time.Time) (ClientSpan, error)
+	// ClientSpans returns every span recorded for ip, oldest first.
+	ClientSpans(ip string) ([]ClientSpan, error)
+}
+
+const (
+	clientAtQuery    = "SELECT ip, name, first_seen, last_seen FROM client_names WHERE ip = ? AND first_seen <= ? ORDER BY first_seen DESC LIMIT 1"
+	clientSpansQuery = "SELECT ip, name, first_seen, last_seen FROM client_names WHERE ip = ? ORDER BY first_seen"
+)
+
+func (s *sqliteStore) ClientAt(ip string, at time.Time) (ClientSpan, error) {
+	spans, err := s.clientSpans(clientAtQuery, ip, at.UnixNano())
+	if err != nil {
+		return ClientSpan{}, err
+	}
+	if len(spans) == 0 {
+		return ClientSpan{}, errors.Wrapf(ErrNotFound, "client %s at %v", ip, at)
+	}
+	return spans[0], nil
+}
+
+func (s *sqliteStore) ClientSpans(ip string) ([]ClientSpan, error) {
+	return s.clientSpans(clientSpansQuery, ip)
+}
+
+func (s *sqliteStore) clientSpans(query string, args ...interface{}) ([]ClientSpan, error) {
+	db, err := s.reader()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying client names")
+	}
+	defer rows.Close()
+	return scanClientSpans(rows)
+}
+
+func scanClientSpans(rows *sql.Rows) ([]ClientSpan, error) {
+	var spans []ClientSpan
+	for rows.Next() {
+		var (
+			span        ClientSpan
+			first, last int64
+		)
+		if err := rows.Scan(&span.IP, &span.Name, &first, &last); err != nil {
+			return nil, errors.Wrap(err, "scanning client name")
+		}
+		span.FirstSeen, span.LastSeen = time.Unix(0, first), time.Unix(0, last)
+		spans = append(spans, span)
+	}
+	return spans, errors.Wrap(rows.Err(), "reading client names")
+}
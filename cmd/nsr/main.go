@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
 	"syscall"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
 
 	"github.com/urfave/cli"
 
@@ -17,31 +26,290 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "nsr"
 	app.Version = nsrecorder.Version
-	app.Commands = []cli.Command{watch}
+	app.Flags = []cli.Flag{logLevelFlag, logFormatFlag}
+	app.Before = setupLogger
+	app.Commands = []cli.Command{watch, replay, migrate, client, query, search, prune, backup, dbCommand}
 	app.Writer = os.Stdout
 	app.ErrWriter = os.Stderr
 	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+		nsrecorder.DefaultLogger().Error("exiting", "error", err)
+		os.Exit(1)
 	}
 }
 
 var (
+	logLevelFlag  = cli.StringFlag{Name: "log-level", EnvVar: "LOG_LEVEL", Value: "info", Usage: "debug, info, warn or error"}
+	logFormatFlag = cli.StringFlag{Name: "log-format", EnvVar: "LOG_FORMAT", Value: "text", Usage: "text or json"}
+
 	topicFlag   = cli.StringFlag{Name: "topic", EnvVar: "TOPIC", Value: "dns"}
 	channelFlag = cli.StringFlag{Name: "channel", EnvVar: "CHANNEL", Value: "recorder-dev"}
 	lookupdFlag = cli.StringSliceFlag{Name: "lookupd", EnvVar: "LOOKUPD", Value: &cli.StringSlice{"127.0.0.1:4161"}}
 	dbFlag      = cli.StringFlag{Name: "db", EnvVar: "DB_FILE", Value: "nsr.db"}
 	verboseFlag = cli.BoolFlag{Name: "verbose", EnvVar: "VERBOSE"}
-	watchFlags  = []cli.Flag{topicFlag, channelFlag, lookupdFlag, dbFlag, verboseFlag}
+	listenFlag  = cli.StringFlag{Name: "listen", EnvVar: "LISTEN", Usage: "address for the HTTP metrics listener, disabled if empty"}
+	staleFlag   = cli.DurationFlag{Name: "stale-after", EnvVar: "STALE_AFTER", Value: 5 * time.Minute, Usage: "unhealthy when no batch was stored for this long"}
+	recentFlag  = cli.IntFlag{Name: "recent", EnvVar: "RECENT_LOOKUPS", Usage: "recent lookups served at /lookups on the listener, 0 to disable"}
+	failFlag    = cli.IntFlag{Name: "max-failures", EnvVar: "MAX_FAILURES", Value: 5, Usage: "unhealthy after this many consecutive store failures"}
+	journalFlag = cli.StringFlag{Name: "journal", EnvVar: "JOURNAL_DIR", Usage: "directory for batches the db could not store, disabled if empty"}
+	journalMax  = cli.Int64Flag{Name: "journal-max-bytes", EnvVar: "JOURNAL_MAX_BYTES", Value: 256 << 20}
+	journalMode = cli.StringFlag{Name: "sqlite-journal-mode", EnvVar: "SQLITE_JOURNAL_MODE", Value: nsrecorder.DefaultSQLiteOptions.JournalMode}
+	synchronous = cli.StringFlag{Name: "sqlite-synchronous", EnvVar: "SQLITE_SYNCHRONOUS", Value: nsrecorder.DefaultSQLiteOptions.Synchronous}
+	busyTimeout = cli.DurationFlag{Name: "sqlite-busy-timeout", EnvVar: "SQLITE_BUSY_TIMEOUT", Value: nsrecorder.DefaultSQLiteOptions.BusyTimeout}
+	pragmaFlag  = cli.StringSliceFlag{Name: "sqlite-pragma", EnvVar: "SQLITE_PRAGMAS", Usage: "additional name=value pragma, may be repeated"}
+	sqliteFlags = []cli.Flag{journalMode, synchronous, busyTimeout, pragmaFlag}
+	watchFlags  = flags([]cli.Flag{topicFlag, channelFlag, lookupdFlag, dbFlag, partitionFlag, postgresFlag, storeFlag, verboseFlag, listenFlag, recentFlag, staleFlag, failFlag, journalFlag, journalMax, pruneInterval}, retentionFlags, sqliteFlags, archiveFlags, forwardFlags, webhookFlags, queueFlags, pseudonymFlags, snapshotFlags, []cli.Flag{backupInterval})
+
+	storeFlag = cli.StringSliceFlag{Name: "store", EnvVar: "STORES", Usage: "store URL, may be repeated; the first replaces --db and --postgres, the others are written best effort"}
+
+	partitionFlag = cli.StringFlag{Name: "sqlite-partition", EnvVar: "SQLITE_PARTITION", Usage: "keep the lookups of every day, week or month in its own db file, named after --db, if set"}
+
+	postgresFlag = cli.StringFlag{Name: "postgres", EnvVar: "POSTGRES_DSN", Usage: "PostgreSQL connection string, used instead of the sqlite db if set"}
+
+	archiveFlag        = cli.StringFlag{Name: "archive", EnvVar: "ARCHIVE_DIR", Usage: "directory for a JSON lines archive of lookups, disabled if empty"}
+	archiveMaxBytes    = cli.Int64Flag{Name: "archive-max-bytes", EnvVar: "ARCHIVE_MAX_BYTES", Value: nsrecorder.DefaultArchiveOptions.MaxBytes, Usage: "rotate the archive at this size, 0 for no limit"}
+	archiveInterval    = cli.DurationFlag{Name: "archive-interval", EnvVar: "ARCHIVE_INTERVAL", Value: nsrecorder.DefaultArchiveOptions.Interval, Usage: "rotate the archive this often, 0 for no limit"}
+	archiveCompression = cli.StringFlag{Name: "archive-compression", EnvVar: "ARCHIVE_COMPRESSION", Value: "gzip", Usage: "gzip, zstd, or none"}
+	archiveMaxFiles    = cli.IntFlag{Name: "archive-max-files", EnvVar: "ARCHIVE_MAX_FILES", Usage: "rotated archives to keep, 0 keeps them all"}
+	archiveMaxAge      = cli.DurationFlag{Name: "archive-max-age", EnvVar: "ARCHIVE_MAX_AGE", Usage: "delete rotated archives older than this, 0 keeps them forever"}
+	archiveFlags       = []cli.Flag{archiveFlag, archiveMaxBytes, archiveInterval, archiveCompression, archiveMaxFiles, archiveMaxAge}
+
+	forwardTopic = cli.StringFlag{Name: "forward-topic", EnvVar: "FORWARD_TOPIC", Usage: "NSQ topic to publish recorded lookups to, disabled if empty"}
+	forwardNSQD  = cli.StringFlag{Name: "forward-nsqd", EnvVar: "FORWARD_NSQD", Value: "127.0.0.1:4150"}
+	forwardFlags = []cli.Flag{forwardTopic, forwardNSQD}
+
+	webhookFlag    = cli.StringFlag{Name: "webhook", EnvVar: "WEBHOOK_URL", Usage: "URL to POST every batch to, disabled if empty"}
+	webhookTimeout = cli.DurationFlag{Name: "webhook-timeout", EnvVar: "WEBHOOK_TIMEOUT", Value: nsrecorder.DefaultWebhookOptions.Timeout}
+	webhookRetries = cli.IntFlag{Name: "webhook-retries", EnvVar: "WEBHOOK_RETRIES", Value: nsrecorder.DefaultWebhookOptions.Retries}
+	webhookBackoff = cli.DurationFlag{Name: "webhook-backoff", EnvVar: "WEBHOOK_BACKOFF", Value: nsrecorder.DefaultWebhookOptions.Backoff, Usage: "delay before the first retry, doubled for each following one"}
+	webhookHeader  = cli.StringSliceFlag{Name: "webhook-header", EnvVar: "WEBHOOK_HEADERS", Usage: "additional \"Name: value\" request header, may be repeated"}
+	webhookSecret  = cli.StringFlag{Name: "webhook-secret-file", EnvVar: "WEBHOOK_SECRET_FILE", Usage: "file holding the key signing request bodies"}
+	webhookGzip    = cli.BoolFlag{Name: "webhook-gzip", EnvVar: "WEBHOOK_GZIP", Usage: "gzip request bodies"}
+	webhookFlags   = []cli.Flag{webhookFlag, webhookTimeout, webhookRetries, webhookBackoff, webhookHeader, webhookSecret, webhookGzip}
+
+	backupDir         = cli.StringFlag{Name: "backup-dir", EnvVar: "BACKUP_DIR", Usage: "directory for snapshots of the sqlite db, none are scheduled if empty"}
+	backupInterval    = cli.DurationFlag{Name: "backup-interval", EnvVar: "BACKUP_INTERVAL", Value: 24 * time.Hour, Usage: "take a snapshot this often"}
+	backupKeep        = cli.IntFlag{Name: "backup-keep", EnvVar: "BACKUP_KEEP", Value: 7, Usage: "snapshots to keep, 0 keeps them all"}
+	backupCompression = cli.StringFlag{Name: "backup-compression", EnvVar: "BACKUP_COMPRESSION", Value: "gzip", Usage: "gzip, or none"}
+	snapshotFlags     = []cli.Flag{backupDir, backupKeep, backupCompression}
+
+	pseudonymMode  = cli.StringFlag{Name: "pseudonymize", EnvVar: "PSEUDONYMIZE", Usage: "replace client ips and names before storing them: hmac or truncate, disabled if empty"}
+	pseudonymKey   = cli.StringFlag{Name: "pseudonym-key-file", EnvVar: "PSEUDONYM_KEY_FILE", Usage: "file holding the key of hmac pseudonyms"}
+	pseudonymNets  = cli.StringFlag{Name: "pseudonym-networks", EnvVar: "PSEUDONYM_NETWORKS", Usage: "comma-separated networks of the clients whose addresses and names are also replaced in answers, the private ones if empty"}
+	pseudonymFlags = []cli.Flag{pseudonymMode, pseudonymKey, pseudonymNets}
+
+	queueSize  = cli.IntFlag{Name: "queue-size", EnvVar: "QUEUE_SIZE", Value: 100, Usage: "batches queued for each of the archive, forward and webhook stores, 0 to write them inline"}
+	queueRetry = cli.DurationFlag{Name: "queue-retry", EnvVar: "QUEUE_RETRY", Value: 5 * time.Second, Usage: "delay before retrying a queued batch"}
+	queueFlags = []cli.Flag{queueSize, queueRetry}
+
+	retainLookups  = cli.DurationFlag{Name: "retain-lookups", EnvVar: "RETAIN_LOOKUPS", Usage: "delete lookups older than this, 0 keeps them forever"}
+	retainHourly   = cli.DurationFlag{Name: "retain-hourly", EnvVar: "RETAIN_HOURLY", Usage: "delete hourly rollups older than this, 0 keeps them forever"}
+	retainDaily    = cli.DurationFlag{Name: "retain-daily", EnvVar: "RETAIN_DAILY", Usage: "delete daily rollups older than this, 0 keeps them forever"}
+	retainPDNS     = cli.DurationFlag{Name: "retain-pdns", EnvVar: "RETAIN_PDNS", Usage: "delete passive DNS sightings last seen before this, 0 keeps them forever"}
+	retainNames    = cli.DurationFlag{Name: "retain-client-names", EnvVar: "RETAIN_CLIENT_NAMES", Usage: "delete client names last held before this, 0 keeps them forever"}
+	retentionFlags = []cli.Flag{retainLookups, retainHourly, retainDaily, retainPDNS, retainNames}
+	pruneInterval  = cli.DurationFlag{Name: "prune-interval", EnvVar: "PRUNE_INTERVAL", Value: time.Hour}
 
 	watch = cli.Command{
 		Name:   "watch",
 		Action: watchAction,
 		Flags:  watchFlags,
 	}
+
+	nsqdFlag        = cli.StringFlag{Name: "nsqd", EnvVar: "NSQD", Value: "127.0.0.1:4150"}
+	replayTopicFlag = cli.StringFlag{Name: "topic", EnvVar: "REPLAY_TOPIC", Value: "dns-replay"}
+	fromFlag        = cli.StringFlag{Name: "from", EnvVar: "REPLAY_FROM", Usage: "RFC3339 start time"}
+	toFlag          = cli.StringFlag{Name: "to", EnvVar: "REPLAY_TO", Usage: "RFC3339 end time"}
+	clientFlag      = cli.StringFlag{Name: "client", EnvVar: "REPLAY_CLIENT", Usage: "only lookups from this client ip"}
+	hostFlag        = cli.StringFlag{Name: "host", EnvVar: "REPLAY_HOST", Usage: "only lookups for hosts containing this string"}
+	speedFlag       = cli.Float64Flag{Name: "speed", EnvVar: "REPLAY_SPEED", Value: 1, Usage: "pacing multiplier, 0 for as fast as possible"}
+	limitFlag       = cli.IntFlag{Name: "limit", EnvVar: "REPLAY_LIMIT"}
+	replayFlags     = flags([]cli.Flag{dbFlag, nsqdFlag, replayTopicFlag, fromFlag, toFlag, clientFlag, hostFlag, speedFlag, limitFlag}, sqliteFlags)
+
+	dryRunFlag   = cli.BoolFlag{Name: "dry-run", Usage: "only report pending migrations"}
+	migrateFlags = append([]cli.Flag{dbFlag, dryRunFlag}, sqliteFlags...)
+
+	migrate = cli.Command{
+		Name:   "migrate",
+		Usage:  "upgrade the schema of the sqlite db",
+		Action: migrateAction,
+		Flags:  migrateFlags,
+	}
+
+	atFlag      = cli.StringFlag{Name: "at", Usage: "RFC3339 time, defaults to every recorded name"}
+	clientFlags = append([]cli.Flag{dbFlag, partitionFlag, atFlag}, sqliteFlags...)
+
+	client = cli.Command{
+		Name:      "client",
+		Usage:     "show the names a client ip had",
+		ArgsUsage: "ip",
+		Action:    clientAction,
+		Flags:     clientFlags,
+	}
+
+	// The query flags have no environment variables, which would apply to
+	// every query run.
+	queryFromFlag  = cli.StringFlag{Name: "from", Usage: "RFC3339 start time"}
+	queryToFlag    = cli.StringFlag{Name: "to", Usage: "RFC3339 end time"}
+	queryLimitFlag = cli.IntFlag{Name: "limit"}
+	offsetFlag     = cli.IntFlag{Name: "offset"}
+	queryFlags     = flags([]cli.Flag{dbFlag, partitionFlag, queryFromFlag, queryToFlag, queryLimitFlag, offsetFlag}, sqliteFlags)
+
+	query = cli.Command{
+		Name:  "query",
+		Usage: "print recorded data as JSON lines",
+		Subcommands: []cli.Command{
+			queryCommand("lookups-by-host", "lookups of a host, newest first", "host", lookupsByHost),
+			queryCommand("lookups-by-client", "lookups made by a client ip, newest first", "ip", lookupsByClient),
+			queryCommand("hosts-for-ip", "records answering an ip", "ip", hostsForIP),
+			queryCommand("ips-for-host", "addresses answered for a host", "host", ipsForHost),
+			queryCommand("top-hosts", "most looked up hosts", "", topHosts),
+			queryCommand("top-clients", "clients making the most lookups", "", topClients),
+		},
+	}
+
+	searchFlags = flags([]cli.Flag{dbFlag, partitionFlag, queryLimitFlag, offsetFlag}, sqliteFlags)
+
+	search = cli.Command{
+		Name:      "search",
+		Usage:     "list the recorded hosts matching a pattern, such as cdn or *.tracking.*",
+		ArgsUsage: "pattern",
+		Action:    searchAction,
+		Flags:     searchFlags,
+	}
+
+	pruneFlags = flags([]cli.Flag{dbFlag, partitionFlag, postgresFlag, storeFlag}, retentionFlags, sqliteFlags)
+
+	prune = cli.Command{
+		Name:   "prune",
+		Usage:  "delete data older than the retention policy",
+		Action: pruneAction,
+		Flags:  pruneFlags,
+	}
+
+	quickFlag      = cli.BoolFlag{Name: "quick", Usage: "run the faster quick_check instead of integrity_check"}
+	incrementFlag  = cli.BoolFlag{Name: "incremental", Usage: "only free unused pages, which needs auto_vacuum=incremental"}
+	autoVacuumFlag = cli.StringFlag{Name: "auto-vacuum", Usage: "set auto_vacuum to none, full or incremental before a full vacuum"}
+	dbFlags        = append([]cli.Flag{dbFlag}, sqliteFlags...)
+
+	dbCommand = cli.Command{
+		Name:  "db",
+		Usage: "inspect and maintain the sqlite db",
+		Subcommands: []cli.Command{
+			{Name: "check", Usage: "check the integrity of the db, failing if it has problems", Action: checkAction, Flags: flags([]cli.Flag{quickFlag}, dbFlags)},
+			{Name: "vacuum", Usage: "rebuild the db to reclaim unused space", Action: vacuumAction, Flags: flags([]cli.Flag{incrementFlag, autoVacuumFlag}, dbFlags)},
+			{Name: "analyze", Usage: "gather statistics for the query planner", Action: analyzeAction, Flags: dbFlags},
+			{Name: "stats", Usage: "show row counts, size and growth of the db", Action: statsAction, Flags: dbFlags},
+		},
+	}
+
+	backupFlags = flags([]cli.Flag{dbFlag, storeFlag}, snapshotFlags, sqliteFlags)
+
+	backup = cli.Command{
+		Name:   "backup",
+		Usage:  "write a snapshot of the sqlite db while it is in use",
+		Action: backupAction,
+		Flags:  backupFlags,
+	}
+
+	replay = cli.Command{
+		Name:   "replay",
+		Usage:  "publish recorded lookups to an NSQ topic",
+		Action: replayAction,
+		Flags:  replayFlags,
+	}
 )
 
 func watchAction(c *cli.Context) error {
 	reportContext(c, watchFlags)
+	if interval := c.Duration("prune-interval"); interval <= 0 {
+		return fmt.Errorf("invalid prune interval %s", interval)
+	}
+	if interval := c.Duration("backup-interval"); c.String("backup-dir") != "" && interval <= 0 {
+		return fmt.Errorf("invalid backup interval %s", interval)
+	}
+
+	// The watcher closes the stores once it has stopped; they are closed
+	// here if it is not started.
+	primary, name, err := primaryStore(c)
+	if err != nil {
+		return err
+	}
+	store := nsrecorder.NamedStore(name, primary)
+	stores := []nsrecorder.Store{store}
+	started := false
+	defer func() {
+		if !started {
+			for _, store := range stores {
+				closeStore(store)
+			}
+		}
+	}()
+	if _, ok := primary.(nsrecorder.Backuper); c.String("backup-dir") != "" && !ok {
+		return fmt.Errorf("store %s cannot be backed up", name)
+	}
+
+	if dir := c.String("journal"); dir != "" {
+		if store, err = nsrecorder.NewJournalStore(store, dir, c.Int64("journal-max-bytes")); err != nil {
+			return err
+		}
+		stores[0] = store
+	}
+	used := map[string]bool{name: true}
+	if urls := c.StringSlice("store"); len(urls) > 1 {
+		for _, u := range urls[1:] {
+			secondary, err := nsrecorder.OpenStore(u)
+			if err != nil {
+				return err
+			}
+			name := storeName(u, used)
+			used[name] = true
+			stores = append(stores, secondaryStore(c, name, secondary))
+		}
+	}
+	if dir := c.String("archive"); dir != "" {
+		archive, err := nsrecorder.NewArchiveStore(dir, archiveOptions(c))
+		if err != nil {
+			return err
+		}
+		stores = append(stores, secondaryStore(c, "archive", archive))
+	}
+	if topic := c.String("forward-topic"); topic != "" {
+		producer, err := newProducer(c.String("forward-nsqd"))
+		if err != nil {
+			return err
+		}
+		defer producer.Stop()
+		stores = append(stores, secondaryStore(c, "forward", nsrecorder.NewForwardStore(producer, topic)))
+	}
+	if url := c.String("webhook"); url != "" {
+		opts, err := webhookOptions(c)
+		if err != nil {
+			return err
+		}
+		stores = append(stores, secondaryStore(c, "webhook", nsrecorder.NewWebhookStoreWithOptions(url, opts)))
+	}
+	if c.Bool("verbose") {
+		stores = append(stores, nsrecorder.BestEffort(nsrecorder.NamedStore("log", nsrecorder.NewLogStore())))
+	}
+	var recent *nsrecorder.MemoryStore
+	if c.String("listen") != "" && c.Int("recent") > 0 {
+		recent = nsrecorder.NewMemoryStore(c.Int("recent"))
+		stores = append(stores, nsrecorder.NamedStore("memory", recent))
+	}
+	if len(stores) > 1 {
+		store = nsrecorder.MultiStore(stores...)
+	}
+	if mode := c.String("pseudonymize"); mode != "" {
+		p, err := pseudonymizer(mode, c.String("pseudonym-key-file"))
+		if err != nil {
+			return err
+		}
+		networks, err := clientNetworks(c.String("pseudonym-networks"))
+		if err != nil {
+			return err
+		}
+		store = nsrecorder.Pseudonymize(store, p, networks)
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -50,12 +318,39 @@ func watchAction(c *cli.Context) error {
 	ctx = context.WithValue(ctx, "topic", c.String("topic"))
 	ctx = context.WithValue(ctx, "channel", c.String("channel"))
 	ctx = context.WithValue(ctx, "lookupd", c.StringSlice("lookupd"))
+	ctx = context.WithValue(ctx, "staleAfter", c.Duration("stale-after"))
+	ctx = context.WithValue(ctx, "maxFailures", c.Int("max-failures"))
+	ctx = context.WithValue(ctx, "pseudonymize", c.String("pseudonymize") != "")
 
-	store := nsrecorder.NewSQLiteStore(c.String("db"))
-	if c.Bool("verbose") {
-		store = nsrecorder.MultiStore(store, nsrecorder.NewLogStore())
-	}
 	w := nsrecorder.NewWatcher(ctx, store)
+	started = true
+
+	if policy := retentionPolicy(c); policy != (nsrecorder.RetentionPolicy{}) {
+		if pruner, ok := primary.(nsrecorder.Pruner); ok {
+			go nsrecorder.PruneEvery(ctx, pruner, policy, c.Duration("prune-interval"))
+		} else {
+			nsrecorder.DefaultLogger().Warn("ignoring retention policy", "store", name)
+		}
+	}
+
+	if dir := c.String("backup-dir"); dir != "" {
+		go nsrecorder.SnapshotEvery(ctx, primary.(nsrecorder.Backuper), dir, snapshotOptions(c), c.Duration("backup-interval"))
+	}
+
+	if addr := c.String("listen"); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", nsrecorder.MetricsHandler(w))
+		mux.Handle("/healthz", nsrecorder.HealthHandler(w))
+		mux.Handle("/readyz", nsrecorder.ReadyHandler(w))
+		if recent != nil {
+			mux.Handle("/lookups", nsrecorder.LookupsHandler(recent))
+		}
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				nsrecorder.DefaultLogger().Error("http listener", "addr", addr, "error", err)
+			}
+		}()
+	}
 
 	<-sigChan
 	cancel()
@@ -64,22 +359,516 @@ func watchAction(c *cli.Context) error {
 	return nil
 }
 
+func migrateAction(c *cli.Context) error {
+	status, err := nsrecorder.MigrateSQLite(c.String("db"), sqliteOptions(c), c.Bool("dry-run"))
+	fmt.Fprintf(c.App.Writer, "schema version %d, latest %d\n", status.Version, status.Latest)
+	for x, description := range status.Pending {
+		state := "pending"
+		if x < len(status.Applied) {
+			state = "applied"
+		}
+		fmt.Fprintf(c.App.Writer, "%5d %-8s %s\n", status.Version+x+1, state, description)
+	}
+	return err
+}
+
+func clientAction(c *cli.Context) error {
+	ip := c.Args().First()
+	if ip == "" {
+		return fmt.Errorf("missing client ip")
+	}
+	at, err := parseTime(c.String("at"))
+	if err != nil {
+		return err
+	}
+
+	store, err := readStore(c)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	history := store.(nsrecorder.ClientHistory)
+
+	var spans []nsrecorder.ClientSpan
+	if at.IsZero() {
+		spans, err = history.ClientSpans(ip)
+	} else {
+		var span nsrecorder.ClientSpan
+		span, err = history.ClientAt(ip, at)
+		spans = append(spans, span)
+	}
+	if err != nil {
+		return err
+	}
+	for _, span := range spans {
+		fmt.Fprintf(c.App.Writer, "%-15s %-30s %s %s\n", span.IP, span.Name, span.FirstSeen.Format(time.RFC3339), span.LastSeen.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// queryFunc returns a slice of results from r.
+type queryFunc func(ctx context.Context, r nsrecorder.Reader, arg string, q nsrecorder.Query) (interface{}, error)
+
+func lookupsByHost(ctx context.Context, r nsrecorder.Reader, host string, q nsrecorder.Query) (interface{}, error) {
+	return r.LookupsByHost(ctx, host, q)
+}
+
+func lookupsByClient(ctx context.Context, r nsrecorder.Reader, ip string, q nsrecorder.Query) (interface{}, error) {
+	return r.LookupsByClient(ctx, ip, q)
+}
+
+func hostsForIP(ctx context.Context, r nsrecorder.Reader, ip string, q nsrecorder.Query) (interface{}, error) {
+	return r.HostsForIP(ctx, ip, q)
+}
+
+func ipsForHost(ctx context.Context, r nsrecorder.Reader, host string, q nsrecorder.Query) (interface{}, error) {
+	return r.IPsForHost(ctx, host, q)
+}
+
+func topHosts(ctx context.Context, r nsrecorder.Reader, _ string, q nsrecorder.Query) (interface{}, error) {
+	return r.TopHosts(ctx, q)
+}
+
+func topClients(ctx context.Context, r nsrecorder.Reader, _ string, q nsrecorder.Query) (interface{}, error) {
+	return r.TopClients(ctx, q)
+}
+
+func queryCommand(name, usage, argsUsage string, run queryFunc) cli.Command {
+	return cli.Command{
+		Name:      name,
+		Usage:     usage,
+		ArgsUsage: argsUsage,
+		Flags:     queryFlags,
+		Action:    func(c *cli.Context) error { return queryAction(c, argsUsage, run) },
+	}
+}
+
+func queryAction(c *cli.Context, argsUsage string, run queryFunc) error {
+	arg := c.Args().First()
+	if argsUsage != "" && arg == "" {
+		return fmt.Errorf("missing %s", argsUsage)
+	}
+	q := nsrecorder.Query{Limit: c.Int("limit"), Offset: c.Int("offset")}
+	var err error
+	if q.From, err = parseTime(c.String("from")); err != nil {
+		return err
+	}
+	if q.To, err = parseTime(c.String("to")); err != nil {
+		return err
+	}
+
+	store, err := readStore(c)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+
+	results, err := run(context.Background(), store.(nsrecorder.Reader), arg, q)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(c.App.Writer)
+	v := reflect.ValueOf(results)
+	for x := 0; x < v.Len(); x++ {
+		if err = enc.Encode(v.Index(x).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func searchAction(c *cli.Context) error {
+	pattern := c.Args().First()
+	if pattern == "" {
+		return fmt.Errorf("missing pattern")
+	}
+
+	store, err := readStore(c)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+
+	hosts, err := store.(nsrecorder.Reader).SearchHosts(context.Background(), pattern, nsrecorder.Query{Limit: c.Int("limit"), Offset: c.Int("offset")})
+	for _, host := range hosts {
+		fmt.Fprintln(c.App.Writer, host)
+	}
+	return err
+}
+
+func pruneAction(c *cli.Context) error {
+	reportContext(c, pruneFlags)
+
+	store, name, err := primaryStore(c)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+
+	pruner, ok := store.(nsrecorder.Pruner)
+	if !ok {
+		return fmt.Errorf("store %s cannot be pruned", name)
+	}
+	result, err := pruner.Prune(context.Background(), retentionPolicy(c), time.Now())
+	fmt.Fprintf(c.App.Writer, "deleted %d lookups, %d hourly and %d daily rollups\n", result.Lookups, result.Hourly, result.Daily)
+	if result.Related > 0 {
+		fmt.Fprintf(c.App.Writer, "deleted %d related rows\n", result.Related)
+	}
+	if result.Partitions > 0 {
+		fmt.Fprintf(c.App.Writer, "deleted %d partitions\n", result.Partitions)
+	}
+	return err
+}
+
+func backupAction(c *cli.Context) error {
+	dir := c.String("backup-dir")
+	if dir == "" {
+		return fmt.Errorf("missing backup directory")
+	}
+	reportContext(c, backupFlags)
+
+	store, name, err := primaryStore(c)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+
+	backuper, ok := store.(nsrecorder.Backuper)
+	if !ok {
+		return fmt.Errorf("store %s cannot be backed up", name)
+	}
+	path, err := nsrecorder.Snapshot(context.Background(), backuper, dir, snapshotOptions(c))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, path)
+	return nil
+}
+
+func checkAction(c *cli.Context) error {
+	problems, err := nsrecorder.CheckSQLite(context.Background(), c.String("db"), sqliteOptions(c), c.Bool("quick"))
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(c.App.Writer, problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check found %d problems", len(problems))
+	}
+	fmt.Fprintln(c.App.Writer, "ok")
+	return nil
+}
+
+func vacuumAction(c *cli.Context) error {
+	reclaimed, err := nsrecorder.VacuumSQLite(context.Background(), c.String("db"), sqliteOptions(c), c.Bool("incremental"), c.String("auto-vacuum"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.Writer, "reclaimed %d bytes\n", reclaimed)
+	return nil
+}
+
+func analyzeAction(c *cli.Context) error {
+	return nsrecorder.AnalyzeSQLite(context.Background(), c.String("db"), sqliteOptions(c))
+}
+
+func statsAction(c *cli.Context) error {
+	stats, err := nsrecorder.SQLiteStats(context.Background(), c.String("db"), sqliteOptions(c))
+	if err != nil {
+		return err
+	}
+	w := c.App.Writer
+	for _, table := range stats.Tables {
+		fmt.Fprintf(w, "%-16s %12d rows\n", table.Table, table.Rows)
+	}
+	fmt.Fprintf(w, "%-16s %12d bytes, %d in the wal, %d free\n", "size", stats.Bytes, stats.WALBytes, stats.FreeBytes)
+	if !stats.Oldest.IsZero() {
+		fmt.Fprintf(w, "%-16s %s\n", "oldest lookup", stats.Oldest.Format(time.RFC3339))
+		fmt.Fprintf(w, "%-16s %s\n", "newest lookup", stats.Newest.Format(time.RFC3339))
+		fmt.Fprintf(w, "%-16s %12.0f lookups, %.0f bytes per day\n", "growth", stats.LookupsPerDay, stats.BytesPerDay)
+	}
+	return nil
+}
+
+func snapshotOptions(c *cli.Context) nsrecorder.SnapshotOptions {
+	opts := nsrecorder.SnapshotOptions{
+		Compression: c.String("backup-compression"),
+		Keep:        c.Int("backup-keep"),
+	}
+	if opts.Compression == "none" {
+		opts.Compression = ""
+	}
+	return opts
+}
+
+func retentionPolicy(c *cli.Context) nsrecorder.RetentionPolicy {
+	return nsrecorder.RetentionPolicy{
+		Lookups: c.Duration("retain-lookups"),
+		Hourly:  c.Duration("retain-hourly"),
+		Daily:   c.Duration("retain-daily"),
+
+		PDNS:        c.Duration("retain-pdns"),
+		ClientNames: c.Duration("retain-client-names"),
+	}
+}
+
+// primaryStore returns the store of the first --store URL, or the postgres
+// store if a connection string was given, or the sqlite store, and its name.
+func primaryStore(c *cli.Context) (nsrecorder.Store, string, error) {
+	if urls := c.StringSlice("store"); len(urls) > 0 {
+		store, err := nsrecorder.OpenStore(urls[0])
+		return store, storeName(urls[0], nil), err
+	}
+	if dsn := c.String("postgres"); dsn != "" {
+		return nsrecorder.NewPostgresStore(dsn), "postgres", nil
+	}
+	opts := sqliteOptions(c)
+	if err := checkPartition(opts); err != nil {
+		return nil, "", err
+	}
+	return nsrecorder.NewSQLiteStoreWithOptions(c.String("db"), opts), "sqlite", nil
+}
+
+// readStore returns the sqlite store of --db to read from, failing instead
+// of creating an empty db when there is none at that path.  A partitioned db
+// is read from the partitions found, which creates none.
+func readStore(c *cli.Context) (nsrecorder.Store, error) {
+	opts := sqliteOptions(c)
+	if err := checkPartition(opts); err != nil {
+		return nil, err
+	}
+	if opts.Partition == "" {
+		if _, err := os.Stat(c.String("db")); err != nil {
+			return nil, err
+		}
+	}
+	return nsrecorder.NewSQLiteStoreWithOptions(c.String("db"), opts), nil
+}
+
+// storeName names the store of rawURL after its scheme, made unique among
+// the names already used.
+func storeName(rawURL string, used map[string]bool) string {
+	name := strings.SplitN(rawURL, ":", 2)[0]
+	for x := 2; used[name]; x++ {
+		name = fmt.Sprintf("%s-%d", strings.SplitN(rawURL, ":", 2)[0], x)
+	}
+	return name
+}
+
+func sqliteOptions(c *cli.Context) nsrecorder.SQLiteOptions {
+	return nsrecorder.SQLiteOptions{
+		JournalMode: c.String("sqlite-journal-mode"),
+		Synchronous: c.String("sqlite-synchronous"),
+		BusyTimeout: c.Duration("sqlite-busy-timeout"),
+		Pragmas:     c.StringSlice("sqlite-pragma"),
+		Partition:   c.String("sqlite-partition"),
+	}
+}
+
+// checkPartition rejects a --sqlite-partition period up front, which the
+// store would only reject once written to or read.
+func checkPartition(opts nsrecorder.SQLiteOptions) error {
+	switch opts.Partition {
+	case "", "day", "week", "month":
+		return nil
+	}
+	return fmt.Errorf("%v %q", nsrecorder.ErrUnknownPartition, opts.Partition)
+}
+
+// secondaryStore wraps a store written besides the primary one so that its
+// failures do not fail batches, behind a queue unless --queue-size is 0.
+func secondaryStore(c *cli.Context, name string, store nsrecorder.Store) nsrecorder.Store {
+	store = nsrecorder.NamedStore(name, store)
+	if size := c.Int("queue-size"); size > 0 {
+		store = nsrecorder.NewQueueStore(store, size, c.Duration("queue-retry"))
+	}
+	return nsrecorder.BestEffort(store)
+}
+
+func archiveOptions(c *cli.Context) nsrecorder.ArchiveOptions {
+	opts := nsrecorder.ArchiveOptions{
+		MaxBytes:    c.Int64("archive-max-bytes"),
+		Interval:    c.Duration("archive-interval"),
+		Compression: c.String("archive-compression"),
+		MaxFiles:    c.Int("archive-max-files"),
+		MaxAge:      c.Duration("archive-max-age"),
+	}
+	if opts.Compression == "none" {
+		opts.Compression = ""
+	}
+	return opts
+}
+
+func webhookOptions(c *cli.Context) (nsrecorder.WebhookOptions, error) {
+	opts := nsrecorder.WebhookOptions{
+		Timeout: c.Duration("webhook-timeout"),
+		Retries: c.Int("webhook-retries"),
+		Backoff: c.Duration("webhook-backoff"),
+		Header:  http.Header{},
+		Gzip:    c.Bool("webhook-gzip"),
+	}
+	for _, header := range c.StringSlice("webhook-header") {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return opts, fmt.Errorf("invalid webhook header %q", header)
+		}
+		opts.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if path := c.String("webhook-secret-file"); path != "" {
+		secret, err := ioutil.ReadFile(path)
+		if err != nil {
+			return opts, err
+		}
+		opts.Secret = bytes.TrimSpace(secret)
+	}
+	return opts, nil
+}
+
+func pseudonymizer(mode, keyFile string) (nsrecorder.Pseudonymizer, error) {
+	var key []byte
+	if keyFile != "" {
+		raw, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = bytes.TrimSpace(raw)
+	}
+	return nsrecorder.NewPseudonymizer(mode, key)
+}
+
+// clientNetworks parses comma-separated CIDRs, defaulting to the private
+// networks.
+func clientNetworks(cidrs string) ([]*net.IPNet, error) {
+	if strings.TrimSpace(cidrs) == "" {
+		return nsrecorder.PrivateNetworks, nil
+	}
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(cidrs, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func closeStore(store nsrecorder.Store) {
+	if err := store.Close(); err != nil {
+		nsrecorder.DefaultLogger().Error("closing store", "error", err)
+	}
+}
+
+func replayAction(c *cli.Context) error {
+	reportContext(c, replayFlags)
+
+	filter := nsrecorder.ReplayFilter{Client: c.String("client"), Host: c.String("host"), Limit: c.Int("limit")}
+	var err error
+	if filter.From, err = parseTime(c.String("from")); err != nil {
+		return err
+	}
+	if filter.To, err = parseTime(c.String("to")); err != nil {
+		return err
+	}
+
+	producer, err := newProducer(c.String("nsqd"))
+	if err != nil {
+		return err
+	}
+	defer producer.Stop()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	n, err := nsrecorder.ReplayWithOptions(ctx, c.String("db"), sqliteOptions(c), filter, producer, c.String("topic"), c.Float64("speed"))
+	nsrecorder.DefaultLogger().Info("replayed lookups", "lookups", n, "topic", c.String("topic"))
+	return err
+}
+
+func newProducer(addr string) (*nsq.Producer, error) {
+	config := nsq.NewConfig()
+	config.ClientID = "nsr"
+	config.Hostname, _ = os.Hostname()
+	config.UserAgent = "nsr go client"
+	producer, err := nsq.NewProducer(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	producer.SetLogger(nsrecorder.DefaultLogger(), nsrecorder.DefaultLogger().NSQLogLevel())
+	return producer, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// secretFlags may hold passwords or tokens, as webhook URLs often do, so
+// their values are not logged.  The key files are only logged by path.
+var secretFlags = map[string]bool{"postgres": true, "store": true, "webhook": true, "webhook-header": true}
+
+// flags concatenates groups of flags.
+func flags(groups ...[]cli.Flag) []cli.Flag {
+	var all []cli.Flag
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
 func reportContext(c *cli.Context, flags []cli.Flag) {
-	log.Printf("Version: %s", nsrecorder.Version)
+	fields := []interface{}{"command", c.Command.Name, "version", nsrecorder.Version}
 	for _, flag := range flags {
-		log.Print(stringFlag(c, flag))
+		value := flagValue(c, flag)
+		if secretFlags[flag.GetName()] && c.IsSet(flag.GetName()) {
+			value = "(set)"
+		}
+		fields = append(fields, flag.GetName(), value)
 	}
+	nsrecorder.DefaultLogger().Info("starting", fields...)
 }
 
-func stringFlag(c *cli.Context, flag cli.Flag) string {
+func flagValue(c *cli.Context, flag cli.Flag) interface{} {
 	switch v := flag.(type) {
 	case cli.BoolFlag:
-		return fmt.Sprintf("\t%10s: %t", flag.GetName(), c.Bool(flag.GetName()))
+		return c.Bool(flag.GetName())
 	case cli.StringFlag:
-		return fmt.Sprintf("\t%10s: %s", flag.GetName(), c.String(flag.GetName()))
+		return c.String(flag.GetName())
+	case cli.DurationFlag:
+		return c.Duration(flag.GetName())
+	case cli.IntFlag:
+		return c.Int(flag.GetName())
+	case cli.Int64Flag:
+		return c.Int64(flag.GetName())
+	case cli.Float64Flag:
+		return c.Float64(flag.GetName())
 	case cli.StringSliceFlag:
-		return fmt.Sprintf("\t%10s: %v", flag.GetName(), c.StringSlice(flag.GetName()))
+		return c.StringSlice(flag.GetName())
+	default:
+		return fmt.Sprintf("(%T) %v", v, v)
+	}
+}
+
+func setupLogger(c *cli.Context) error {
+	level, err := nsrecorder.ParseLevel(c.GlobalString("log-level"))
+	if err != nil {
+		return err
+	}
+	switch format := c.GlobalString("log-format"); format {
+	case "text", "json":
+		nsrecorder.SetLogger(nsrecorder.NewLogger(os.Stderr, level, format == "json"))
+		return nil
 	default:
-		return fmt.Sprintf("\t%10s: (%T) %v", flag.GetName(), v, v)
+		return fmt.Errorf("unknown log format %q", format)
 	}
 }
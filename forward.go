@@ -0,0 +1,68 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/pkg/errors"
+)
+
+// MultiPublisher is the subset of *nsq.Producer needed to forward lookups.
+type MultiPublisher interface {
+	MultiPublish(topic string, body [][]byte) error
+}
+
+// NewForwardStore returns a Store publishing every lookup it accepts to
+// topic, one message per lookup, in the JSON format of the archive.  Each
+// batch is published with a single MultiPublish.
+func NewForwardStore(pub MultiPublisher, topic string) Store {
+	return &forwardStore{pub: pub, topic: topic}
+}
+
+// NewNSQStore returns a forward store publishing to topic on the nsqd at
+// addr with a producer of its own, stopped by Close.
+func NewNSQStore(addr, topic string) (Store, error) {
+	config := nsq.NewConfig()
+	config.ClientID = "nsr"
+	config.Hostname, _ = os.Hostname()
+	config.UserAgent = "nsr go client"
+	producer, err := nsq.NewProducer(addr, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating nsq producer")
+	}
+	producer.SetLogger(logger, logger.NSQLogLevel())
+	return &forwardStore{pub: producer, topic: topic, stop: producer.Stop}, nil
+}
+
+type forwardStore struct {
+	pub   MultiPublisher
+	topic string
+	stop  func()
+}
+
+func (s *forwardStore) Accept(_ context.Context, batch Batch) error {
+	if len(batch.Lookups) == 0 {
+		return nil
+	}
+	names := batch.clientNames()
+	bodies := make([][]byte, 0, len(batch.Lookups))
+	for _, lookup := range batch.Lookups {
+		body, err := json.Marshal(archiveEntry{Lookup: lookup, ClientName: names[lookup.Client]})
+		if err != nil {
+			return errors.Wrap(err, "marshaling forwarded lookup")
+		}
+		bodies = append(bodies, body)
+	}
+	return errors.Wrapf(s.pub.MultiPublish(s.topic, bodies), "publishing to %s", s.topic)
+}
+
+// Close stops the producer of an nsq store; the publisher of other forward
+// stores belongs to the caller.
+func (s *forwardStore) Close() error {
+	if s.stop != nil {
+		s.stop()
+	}
+	return nil
+}
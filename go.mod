@@ -4,6 +4,8 @@ go 1.12
 
 require (
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
+	github.com/klauspost/compress v1.11.13
+	github.com/lib/pq v1.9.0
 	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/nsqio/go-nsq v1.0.7
 	github.com/pkg/errors v0.8.1
@@ -0,0 +1,90 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultStaleAfter  = 5 * time.Minute
+	defaultMaxFailures = 5
+
+	// batchTimeout bounds the time a store has to accept a batch, and
+	// readyTimeout the time it has to report its health.
+	batchTimeout = time.Minute
+	readyTimeout = 5 * time.Second
+)
+
+var (
+	ErrNotConnected   = errors.New("not connected to nsqd")
+	ErrStoreNotReady  = errors.New("store not ready")
+	ErrStoreFailing   = errors.New("store keeps failing")
+	ErrFlushesStalled = errors.New("no batch stored recently")
+)
+
+// HealthHandler responds with 503 Service Unavailable while w is unhealthy.
+func HealthHandler(w *Watcher) http.Handler { return checkHandler(w.Healthy) }
+
+// ReadyHandler responds with 503 Service Unavailable until w is ready.
+func ReadyHandler(w *Watcher) http.Handler { return checkHandler(w.Ready) }
+
+func checkHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte("ok\n"))
+	})
+}
+
+// Ready returns an error until w is connected to at least one nsqd, and
+// while its store, if it is a HealthChecker, reports an error.
+func (w *Watcher) Ready() error {
+	if w.consumer == nil || w.consumer.Stats().Connections == 0 {
+		return ErrNotConnected
+	}
+	if checker, ok := w.store.(HealthChecker); ok {
+		ctx, cancel := context.WithTimeout(w.ctx, readyTimeout)
+		defer cancel()
+		if err := checker.Healthy(ctx); err != nil {
+			return errors.Wrap(ErrStoreNotReady, err.Error())
+		}
+	}
+	return nil
+}
+
+// Healthy returns an error when the store failed too many batches in a row,
+// or when messages have been received but no batch has been stored for longer
+// than the stale interval.
+func (w *Watcher) Healthy() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failures >= w.maxFailures {
+		return errors.Wrapf(ErrStoreFailing, "%d consecutive failures", w.failures)
+	}
+	if w.lastReceived.After(w.lastFlush) && time.Since(w.lastFlush) > w.staleAfter {
+		return errors.Wrapf(ErrFlushesStalled, "last batch stored at %v", w.lastFlush)
+	}
+	return nil
+}
+
+func (w *Watcher) received() {
+	w.mu.Lock()
+	w.lastReceived = time.Now()
+	w.mu.Unlock()
+}
+
+func (w *Watcher) flushed(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.failures++
+		return
+	}
+	w.failures = 0
+	w.lastFlush = time.Now()
+}
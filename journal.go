@@ -0,0 +1,302 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	journalFile   = "journal.jsonl"
+	journalOffset = "journal.offset"
+	journalDead   = "journal.dead.jsonl"
+
+	// journalAttempts is how many times the oldest journaled batch is
+	// replayed into a healthy store before it is moved to the dead-letter
+	// file, so that a batch the store always rejects does not hold up the
+	// ones after it.
+	journalAttempts = 5
+
+	// journalDrain is how often the journal is replayed when no batch
+	// arrives to trigger it.
+	journalDrain = 30 * time.Second
+)
+
+// ErrJournaled is the cause of the error returned for a batch the store
+// failed to accept but that was journaled.  The batch is safe to acknowledge,
+// while the error still reports the failing store.
+var ErrJournaled = errors.New("batch journaled")
+
+// NewJournalStore wraps store so that batches it fails to accept are
+// appended to a journal in dir and reported with ErrJournaled.  Journaled
+// batches are replayed into store, in order, before any newer batch is
+// accepted and every 30 seconds.  A batch that fails to replay 5 times while
+// the store reports itself healthy is moved to journal.dead.jsonl in dir.
+// Once the journal would grow beyond maxBytes, failing batches are rejected
+// as they would be without a journal.
+func NewJournalStore(store Store, dir string, maxBytes int64) (Store, error) {
+	if maxBytes <= 0 {
+		return nil, errors.Errorf("invalid journal size %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating journal directory")
+	}
+	s := &journalStore{
+		store:    store,
+		path:     filepath.Join(dir, journalFile),
+		offset:   filepath.Join(dir, journalOffset),
+		dead:     filepath.Join(dir, journalDead),
+		maxBytes: maxBytes,
+		done:     make(chan struct{}),
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.size = info.Size()
+		if s.replayed, err = readOffset(s.offset); err != nil {
+			return nil, err
+		}
+	} else if err = os.Remove(s.offset); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "removing journal offset")
+	}
+	metrics.journalBytes.set(s.size)
+	go s.drainEvery(journalDrain)
+	return s, nil
+}
+
+// Journaled says whether err only reports batches that were journaled, by
+// a journal store or by every failed store of a MultiStore.
+func Journaled(err error) bool {
+	if errs, ok := errors.Cause(err).(StoreErrors); ok {
+		for _, err := range errs {
+			if !Journaled(err) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	}
+	return err != nil && errors.Cause(err) == ErrJournaled
+}
+
+type journalStore struct {
+	store    Store
+	path     string
+	offset   string
+	dead     string
+	maxBytes int64
+	done     chan struct{}
+
+	mu   sync.Mutex
+	size int64
+	// replayed is the number of bytes at the start of the journal that
+	// were already replayed.
+	replayed int64
+	// attempts is the number of times the batch at replayed failed to
+	// replay into a healthy store.
+	attempts int
+	closed   bool
+}
+
+func (s *journalStore) Accept(ctx context.Context, batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.drain(ctx); err != nil {
+		return s.append(batch, err)
+	}
+	if err := s.store.Accept(ctx, batch); err != nil {
+		return s.append(batch, err)
+	}
+	return nil
+}
+
+func (s *journalStore) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	s.mu.Unlock()
+	return s.store.Close()
+}
+
+func (s *journalStore) Healthy(ctx context.Context) error {
+	if checker, ok := s.store.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
+
+// drainEvery replays the journal every interval until the store is closed.
+func (s *journalStore) drainEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+		if err := s.drain(ctx); err != nil {
+			logger.Debug("replaying journal", "store", "journal", "error", err)
+		}
+		cancel()
+		s.mu.Unlock()
+	}
+}
+
+func (s *journalStore) append(batch Batch, cause error) error {
+	line, err := json.Marshal(batch)
+	if err != nil {
+		return errors.Wrap(err, "marshaling journal entry")
+	}
+	line = append(line, '\n')
+	if s.size+int64(len(line)) > s.maxBytes {
+		metrics.journalRejected.inc()
+		return errors.Wrapf(cause, "journal full at %d bytes", s.size)
+	}
+	if err = appendLine(s.path, line); err != nil {
+		return errors.Wrap(err, "writing journal")
+	}
+
+	s.size += int64(len(line))
+	metrics.journalSpilled.inc()
+	metrics.journalBytes.set(s.size)
+	logger.Warn("journaled batch", "store", "journal", "clients", len(batch.Clients), "lookups", len(batch.Lookups), "journal_bytes", s.size, "error", cause)
+	return errors.Wrap(ErrJournaled, cause.Error())
+}
+
+// drain replays the journal into the store, recording how far it got so
+// that what was replayed is not replayed again, and removes the journal once
+// it is fully replayed.
+func (s *journalStore) drain(ctx context.Context) error {
+	if s.size == 0 {
+		return nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return errors.Wrap(err, "opening journal")
+	}
+	defer f.Close()
+	if _, err = f.Seek(s.replayed, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seeking journal")
+	}
+
+	r := bufio.NewReader(f)
+	replayed := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "reading journal")
+		}
+
+		batch := Batch{}
+		if err = json.Unmarshal(line, &batch); err != nil {
+			logger.Error("dropping corrupt journal entry", "store", "journal", "error", err)
+		} else if err = s.store.Accept(ctx, batch); err != nil {
+			if !s.failed(ctx) {
+				return err
+			}
+			if derr := appendLine(s.dead, line); derr != nil {
+				return errors.Wrap(derr, "writing dead journal entry")
+			}
+			metrics.journalDead.inc()
+			logger.Error("moved journal entry to dead letters", "store", "journal", "file", s.dead, "attempts", s.attempts, "error", err)
+		} else {
+			replayed++
+			metrics.journalReplayed.inc()
+		}
+		if err = writeOffset(s.offset, s.replayed+int64(len(line))); err != nil {
+			return err
+		}
+		s.replayed += int64(len(line))
+		s.attempts = 0
+	}
+
+	// Removing the journal first leaves, at worst, an offset without a
+	// journal, which NewJournalStore discards.
+	if err = os.Remove(s.path); err != nil {
+		return errors.Wrap(err, "removing journal")
+	}
+	if err = os.Remove(s.offset); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing journal offset")
+	}
+	logger.Info("replayed journal", "store", "journal", "batches", replayed)
+	s.size, s.replayed = 0, 0
+	metrics.journalBytes.set(0)
+	return nil
+}
+
+// failed counts a failed replay of the oldest journaled batch, unless the
+// store reports itself unhealthy, which blames the store rather than the
+// batch, and says whether the batch has run out of attempts.
+func (s *journalStore) failed(ctx context.Context) bool {
+	if checker, ok := s.store.(HealthChecker); ok && checker.Healthy(ctx) != nil {
+		return false
+	}
+	s.attempts++
+	return s.attempts >= journalAttempts
+}
+
+// appendLine appends line to the file at path, creating it if needed, and
+// syncs it.
+func appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(line); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func readOffset(path string) (int64, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "reading journal offset")
+	}
+	offset, err := strconv.ParseInt(string(bytes.TrimSpace(raw)), 10, 64)
+	return offset, errors.Wrap(err, "parsing journal offset")
+}
+
+// writeOffset replaces the offset at path, so that it holds either the old
+// or the new offset even if nsr stops while writing it.
+func writeOffset(path string, offset int64) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "creating journal offset")
+	}
+	_, err = f.WriteString(strconv.FormatInt(offset, 10) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	return errors.Wrap(err, "writing journal offset")
+}
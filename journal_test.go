@@ -0,0 +1,257 @@
+package nsrecorder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// journalTestStore records the host of every batch it accepts, and rejects
+// the batches for which reject returns an error.
+type journalTestStore struct {
+	mu        sync.Mutex
+	reject    func(host string) error
+	unhealthy error
+	accepted  []string
+}
+
+func (s *journalTestStore) Accept(ctx context.Context, batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host := batch.Lookups[0].Host
+	if s.reject != nil {
+		if err := s.reject(host); err != nil {
+			return err
+		}
+	}
+	s.accepted = append(s.accepted, host)
+	return nil
+}
+
+func (s *journalTestStore) Close() error { return nil }
+
+func (s *journalTestStore) Healthy(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unhealthy
+}
+
+func (s *journalTestStore) hosts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.accepted...)
+}
+
+func journalBatch(host string) Batch {
+	return Batch{Lookups: []Lookup{{When: time.Unix(0, 0).UTC(), Client: "10.0.0.1", Host: host}}}
+}
+
+// journalHosts returns the host of every batch in the journal file at path.
+func journalHosts(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var hosts []string
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		batch := Batch{}
+		if err = json.Unmarshal(lines.Bytes(), &batch); err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, batch.Lookups[0].Host)
+	}
+	return hosts
+}
+
+func journalTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "nsr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+var errJournalTest = errors.New("rejected")
+
+func rejectAll(string) error { return errJournalTest }
+
+func TestJournalAppendAndDrain(t *testing.T) {
+	dir, cleanup := journalTestDir(t)
+	defer cleanup()
+	store := &journalTestStore{reject: rejectAll, unhealthy: errJournalTest}
+	s, err := NewJournalStore(store, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	for _, host := range []string{"a", "b", "c"} {
+		if err = s.Accept(ctx, journalBatch(host)); !Journaled(err) {
+			t.Fatalf("Accept(%s) = %v, want a journaled batch", host, err)
+		}
+	}
+	if got, want := journalHosts(t, filepath.Join(dir, journalFile)), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("journaled %q, want %q", got, want)
+	}
+
+	store.mu.Lock()
+	store.reject, store.unhealthy = nil, nil
+	store.mu.Unlock()
+	if err = s.Accept(ctx, journalBatch("d")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.hosts(), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("accepted %q, want %q", got, want)
+	}
+	for _, name := range []string{journalFile, journalOffset} {
+		if _, err = os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left after replaying the journal: %v", name, err)
+		}
+	}
+}
+
+func TestJournalOffsetAcrossReopen(t *testing.T) {
+	dir, cleanup := journalTestDir(t)
+	defer cleanup()
+	store := &journalTestStore{reject: rejectAll, unhealthy: errJournalTest}
+	s, err := NewJournalStore(store, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, host := range []string{"a", "b"} {
+		if err = s.Accept(ctx, journalBatch(host)); !Journaled(err) {
+			t.Fatalf("Accept(%s) = %v, want a journaled batch", host, err)
+		}
+	}
+	// Replaying stops at b, and c is journaled after it.
+	store.mu.Lock()
+	store.reject = func(host string) error {
+		if host == "a" {
+			return nil
+		}
+		return errJournalTest
+	}
+	store.mu.Unlock()
+	if err = s.Accept(ctx, journalBatch("c")); !Journaled(err) {
+		t.Fatalf("Accept(c) = %v, want a journaled batch", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.Lock()
+	store.reject, store.unhealthy = nil, nil
+	store.mu.Unlock()
+	s, err = NewJournalStore(store, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.Accept(ctx, journalBatch("d")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.hosts(), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("accepted %q, want %q", got, want)
+	}
+}
+
+func TestJournalFull(t *testing.T) {
+	dir, cleanup := journalTestDir(t)
+	defer cleanup()
+	line, err := json.Marshal(journalBatch("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &journalTestStore{reject: rejectAll, unhealthy: errJournalTest}
+	s, err := NewJournalStore(store, dir, int64(len(line)+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	if err = s.Accept(ctx, journalBatch("a")); !Journaled(err) {
+		t.Fatalf("Accept(a) = %v, want a journaled batch", err)
+	}
+	if err = s.Accept(ctx, journalBatch("b")); err == nil || Journaled(err) {
+		t.Fatalf("Accept(b) = %v, want a rejected batch", err)
+	}
+	if got, want := journalHosts(t, filepath.Join(dir, journalFile)), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("journaled %q, want %q", got, want)
+	}
+
+	if _, err = NewJournalStore(store, dir, 0); err == nil {
+		t.Error("no error for a journal of 0 bytes")
+	}
+}
+
+func TestJournalDeadLetter(t *testing.T) {
+	dir, cleanup := journalTestDir(t)
+	defer cleanup()
+	store := &journalTestStore{reject: rejectAll, unhealthy: errJournalTest}
+	s, err := NewJournalStore(store, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	if err = s.Accept(ctx, journalBatch("bad")); !Journaled(err) {
+		t.Fatalf("Accept(bad) = %v, want a journaled batch", err)
+	}
+	store.mu.Lock()
+	store.reject = func(host string) error {
+		if host == "bad" {
+			return errJournalTest
+		}
+		return nil
+	}
+	store.mu.Unlock()
+
+	// Failures while the store is unhealthy do not count.
+	for x := 0; x < journalAttempts; x++ {
+		if err = s.Accept(ctx, journalBatch("down")); !Journaled(err) {
+			t.Fatalf("Accept(down) = %v, want a journaled batch", err)
+		}
+	}
+	store.mu.Lock()
+	store.unhealthy = nil
+	store.mu.Unlock()
+	for x := 1; x < journalAttempts; x++ {
+		if err = s.Accept(ctx, journalBatch("held")); !Journaled(err) {
+			t.Fatalf("Accept(held) = %v, want a journaled batch", err)
+		}
+	}
+	if hosts := store.hosts(); len(hosts) > 0 {
+		t.Fatalf("accepted %q before bad was given up", hosts)
+	}
+
+	if err = s.Accept(ctx, journalBatch("next")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := journalHosts(t, filepath.Join(dir, journalDead)), []string{"bad"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dead letters %q, want %q", got, want)
+	}
+	want := []string{"down", "down", "down", "down", "down", "held", "held", "held", "held", "next"}
+	if got := store.hosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("accepted %q, want %q", got, want)
+	}
+}
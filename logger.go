@@ -0,0 +1,178 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level named s.
+func ParseLevel(s string) (Level, error) {
+	for x, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(x), nil
+		}
+	}
+	return LevelInfo, errors.Errorf("unknown log level %q", s)
+}
+
+var logger = NewLogger(os.Stderr, LevelInfo, false)
+
+// SetLogger replaces the Logger used by the package.
+func SetLogger(l *Logger) { logger = l }
+
+// DefaultLogger returns the Logger used by the package.
+func DefaultLogger() *Logger { return logger }
+
+// NewLogger returns a Logger writing entries at or above level to out, as
+// logfmt style text or, if asJSON is set, as one JSON object per line.
+func NewLogger(out io.Writer, level Level, asJSON bool) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level, json: asJSON}
+}
+
+// Logger writes leveled, structured log entries.  Fields are given as
+// alternating keys and values.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	json   bool
+	fields []interface{}
+}
+
+// With returns a Logger that adds fields to every entry.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	c := *l
+	c.fields = append(append([]interface{}{}, l.fields...), fields...)
+	return &c
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...interface{})  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...interface{})  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...interface{}) { l.log(LevelError, msg, fields) }
+
+// Output lets a Logger be passed to SetLogger on go-nsq consumers and
+// producers.
+func (l *Logger) Output(_ int, s string) error {
+	level := LevelInfo
+	switch {
+	case strings.HasPrefix(s, "DBG"):
+		level = LevelDebug
+	case strings.HasPrefix(s, "WRN"):
+		level = LevelWarn
+	case strings.HasPrefix(s, "ERR"):
+		level = LevelError
+	}
+	if len(s) > 4 {
+		s = s[4:]
+	}
+	l.log(level, strings.TrimSpace(s), []interface{}{"component", "nsq"})
+	return nil
+}
+
+// NSQLogLevel returns the go-nsq log level matching the level of l.
+func (l *Logger) NSQLogLevel() nsq.LogLevel { return nsq.LogLevel(l.level) }
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+	all := append([]interface{}{
+		"time", time.Now().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg,
+	}, l.fields...)
+	all = append(all, fields...)
+	if len(all)%2 != 0 {
+		all = append(all, "(MISSING)")
+	}
+
+	var b bytes.Buffer
+	if l.json {
+		writeJSON(&b, all)
+	} else {
+		writeText(&b, all)
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(b.Bytes())
+}
+
+func writeJSON(b *bytes.Buffer, fields []interface{}) {
+	b.WriteByte('{')
+	for x := 0; x < len(fields); x += 2 {
+		if x > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[x]))
+		b.Write(key)
+		b.WriteByte(':')
+		value, err := json.Marshal(jsonValue(fields[x+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[x+1]))
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Time:
+		return t
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	default:
+		return v
+	}
+}
+
+func writeText(b *bytes.Buffer, fields []interface{}) {
+	for x := 0; x < len(fields); x += 2 {
+		if x > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fmt.Sprint(fields[x]))
+		b.WriteByte('=')
+		value := fmt.Sprint(fields[x+1])
+		if value == "" || strings.ContainsAny(value, " \"=\t\n") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+}
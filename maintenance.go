@@ -0,0 +1,268 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotIncremental is returned by an incremental VacuumSQLite of a db
+// without incremental auto vacuum.
+var ErrNotIncremental = errors.New("auto_vacuum is not incremental")
+
+// TableCount is the number of rows of a table.
+type TableCount struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+// DBStats describes the size and contents of a sqlite db.
+type DBStats struct {
+	Tables []TableCount `json:"tables"`
+	// Bytes is the size of the db file, WALBytes that of its write-ahead
+	// log, and FreeBytes the unused part of the db file that a vacuum
+	// would reclaim.
+	Bytes     int64 `json:"bytes"`
+	WALBytes  int64 `json:"wal_bytes"`
+	FreeBytes int64 `json:"free_bytes"`
+	// Oldest and Newest are the times of the first and last recorded
+	// lookups.
+	Oldest time.Time `json:"oldest"`
+	Newest time.Time `json:"newest"`
+	// LookupsPerDay and BytesPerDay average the growth of the db between
+	// Oldest and Newest.
+	LookupsPerDay float64 `json:"lookups_per_day"`
+	BytesPerDay   float64 `json:"bytes_per_day"`
+}
+
+// CheckSQLite runs integrity_check, or quick_check if quick is set, on the
+// sqlite db at path and returns the problems found, none if it is sound.
+func CheckSQLite(ctx context.Context, path string, opts SQLiteOptions, quick bool) ([]string, error) {
+	db, err := openSQLite(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	pragma := "PRAGMA integrity_check"
+	if quick {
+		pragma = "PRAGMA quick_check"
+	}
+	rows, err := db.QueryContext(ctx, pragma)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking integrity")
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var problem string
+		if err = rows.Scan(&problem); err != nil {
+			return nil, errors.Wrap(err, "scanning integrity check")
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems, errors.Wrap(rows.Err(), "checking integrity")
+}
+
+// VacuumSQLite rebuilds the sqlite db at path, or with incremental set,
+// only frees its unused pages, which requires incremental auto vacuum.  A
+// full vacuum first sets the auto vacuum mode to autoVacuum, if given:
+// "none", "full" or "incremental".  It returns the bytes reclaimed.
+func VacuumSQLite(ctx context.Context, path string, opts SQLiteOptions, incremental bool, autoVacuum string) (int64, error) {
+	switch autoVacuum {
+	case "", "none", "full", "incremental":
+	default:
+		return 0, errors.Errorf("invalid auto_vacuum %q", autoVacuum)
+	}
+	db, err := openSQLite(path, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	// Pragmas apply to a connection, so every statement must share one.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "opening sqlite3 db connection")
+	}
+	defer conn.Close()
+
+	before, err := fileSize(path)
+	if err != nil {
+		return 0, err
+	}
+	if incremental {
+		var mode int
+		if err = conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+			return 0, errors.Wrap(err, "reading auto_vacuum")
+		}
+		if mode != 2 {
+			return 0, ErrNotIncremental
+		}
+		// incremental_vacuum returns a row per freed page; they must be
+		// read for it to run to the end.
+		rows, err := conn.QueryContext(ctx, "PRAGMA incremental_vacuum")
+		if err != nil {
+			return 0, errors.Wrap(err, "vacuuming")
+		}
+		for rows.Next() {
+		}
+		if err = rows.Close(); err != nil {
+			return 0, errors.Wrap(err, "vacuuming")
+		}
+	} else {
+		if autoVacuum != "" {
+			if _, err = conn.ExecContext(ctx, "PRAGMA auto_vacuum = "+autoVacuum); err != nil {
+				return 0, errors.Wrap(err, "setting auto_vacuum")
+			}
+		}
+		if _, err = conn.ExecContext(ctx, "VACUUM"); err != nil {
+			return 0, errors.Wrap(err, "vacuuming")
+		}
+	}
+	// Move the vacuumed pages from the write-ahead log into the db file.
+	if _, err = conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return 0, errors.Wrap(err, "checkpointing")
+	}
+
+	after, err := fileSize(path)
+	return before - after, err
+}
+
+// AnalyzeSQLite gathers the statistics the sqlite query planner uses on
+// the db at path.
+func AnalyzeSQLite(ctx context.Context, path string, opts SQLiteOptions) error {
+	db, err := openSQLite(path, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.ExecContext(ctx, "ANALYZE")
+	return errors.Wrap(err, "analyzing")
+}
+
+// SQLiteStats returns the size and contents of the sqlite db at path.
+func SQLiteStats(ctx context.Context, path string, opts SQLiteOptions) (DBStats, error) {
+	stats := DBStats{}
+	db, err := openSQLite(path, opts)
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+
+	if err = checkSchema(db); err != nil {
+		return stats, err
+	}
+	tables, err := userTables(ctx, db)
+	if err != nil {
+		return stats, err
+	}
+	for _, table := range tables {
+		count := TableCount{Table: table}
+		if err = db.QueryRowContext(ctx, `SELECT count(*) FROM "`+table+`"`).Scan(&count.Rows); err != nil {
+			return stats, errors.Wrapf(err, "counting %s", table)
+		}
+		stats.Tables = append(stats.Tables, count)
+	}
+
+	var pageSize, freePages int64
+	if err = db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return stats, errors.Wrap(err, "reading page_size")
+	}
+	if err = db.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&freePages); err != nil {
+		return stats, errors.Wrap(err, "reading freelist_count")
+	}
+	stats.FreeBytes = pageSize * freePages
+	if stats.Bytes, err = fileSize(path); err != nil {
+		return stats, err
+	}
+	if stats.WALBytes, err = fileSize(path + "-wal"); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return stats, err
+	}
+
+	var (
+		lookups        int64
+		oldest, newest sql.NullInt64
+	)
+	if err = db.QueryRowContext(ctx, "SELECT count(*), min(ts), max(ts) FROM lookups").Scan(&lookups, &oldest, &newest); err != nil {
+		return stats, errors.Wrap(err, "reading lookup times")
+	}
+	if !oldest.Valid {
+		return stats, nil
+	}
+	stats.Oldest, stats.Newest = time.Unix(0, oldest.Int64).UTC(), time.Unix(0, newest.Int64).UTC()
+	if days := stats.Newest.Sub(stats.Oldest).Hours() / 24; days > 0 {
+		stats.LookupsPerDay = float64(lookups) / days
+		stats.BytesPerDay = float64(stats.Bytes+stats.WALBytes-stats.FreeBytes) / days
+	}
+	return stats, nil
+}
+
+// userTables returns the tables of db, sorted, leaving out the internal
+// tables of sqlite, and virtual tables and theirs: a virtual table can not
+// be read without its module, such as fts5, and the host index holds no rows
+// of its own.
+func userTables(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, sql FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, errors.Wrap(err, "listing tables")
+	}
+	defer rows.Close()
+
+	var tables, virtual []string
+	for rows.Next() {
+		var (
+			name string
+			ddl  sql.NullString
+		)
+		if err = rows.Scan(&name, &ddl); err != nil {
+			return nil, errors.Wrap(err, "scanning tables")
+		}
+		tables = append(tables, name)
+		if strings.HasPrefix(strings.ToUpper(ddl.String), "CREATE VIRTUAL TABLE") {
+			virtual = append(virtual, name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "listing tables")
+	}
+
+	var user []string
+	for _, table := range tables {
+		shadow := false
+		for _, name := range virtual {
+			shadow = shadow || table == name || strings.HasPrefix(table, name+"_")
+		}
+		if !shadow {
+			user = append(user, table)
+		}
+	}
+	sort.Strings(user)
+	return user, nil
+}
+
+// openSQLite opens the existing sqlite db at path.
+func openSQLite(path string, opts SQLiteOptions) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, errors.Wrap(err, "checking sqlite db")
+	}
+	db, err := openSQLiteDB(path, opts)
+	return db, errors.Wrap(err, "opening sqlite3 db connection")
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "checking file size")
+	}
+	return info.Size(), nil
+}
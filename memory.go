@@ -0,0 +1,233 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// NewMemoryStore returns a MemoryStore keeping the last size lookups and
+// clients.
+func NewMemoryStore(size int) *MemoryStore {
+	if size < 1 {
+		size = 1
+	}
+	return &MemoryStore{
+		lookups: make([]Lookup, 0, size),
+		clients: make([]Client, 0, size),
+		subs:    map[chan Batch]struct{}{},
+	}
+}
+
+// MemoryStore is a Store keeping the last lookups and clients it accepted
+// in ring buffers, with running counts, and passing every batch on to its
+// subscribers.  It is safe for concurrent use.  Batches are not copied, so
+// neither the store nor its subscribers may modify them.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	lookups  []Lookup
+	nextLook int
+	clients  []Client
+	nextCli  int
+	counts   MemoryCounts
+	subs     map[chan Batch]struct{}
+	closed   bool
+}
+
+// MemoryCounts are the running counts of a MemoryStore.
+type MemoryCounts struct {
+	Batches uint64 `json:"batches"`
+	Lookups uint64 `json:"lookups"`
+	Clients uint64 `json:"clients"`
+	// Dropped counts the batches not passed on to a subscriber because
+	// its channel was full.
+	Dropped uint64 `json:"dropped"`
+}
+
+func (s *MemoryStore) Accept(_ context.Context, batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, lookup := range batch.Lookups {
+		if len(s.lookups) < cap(s.lookups) {
+			s.lookups = append(s.lookups, lookup)
+			continue
+		}
+		s.lookups[s.nextLook] = lookup
+		s.nextLook = (s.nextLook + 1) % len(s.lookups)
+	}
+	for _, client := range batch.Clients {
+		if len(s.clients) < cap(s.clients) {
+			s.clients = append(s.clients, client)
+			continue
+		}
+		s.clients[s.nextCli] = client
+		s.nextCli = (s.nextCli + 1) % len(s.clients)
+	}
+	s.counts.Batches++
+	s.counts.Lookups += uint64(len(batch.Lookups))
+	s.counts.Clients += uint64(len(batch.Clients))
+
+	for sub := range s.subs {
+		select {
+		case sub <- batch:
+		default:
+			s.counts.Dropped++
+		}
+	}
+	return nil
+}
+
+// Close closes the subscription channels.  Batches accepted afterwards are
+// still kept.
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.subs {
+		close(sub)
+		delete(s.subs, sub)
+	}
+	s.closed = true
+	return nil
+}
+
+// Lookups returns the kept lookups, oldest first.  Their slices are shared
+// with the store and subscribers, and must not be modified.
+func (s *MemoryStore) Lookups() []Lookup {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.kept()
+}
+
+// kept returns the kept lookups, oldest first.  The caller must hold s.mu.
+func (s *MemoryStore) kept() []Lookup {
+	lookups := make([]Lookup, 0, len(s.lookups))
+	lookups = append(lookups, s.lookups[s.nextLook:]...)
+	return append(lookups, s.lookups[:s.nextLook]...)
+}
+
+// Clients returns the latest name of every kept client, sorted by IP.
+func (s *MemoryStore) Clients() []Client {
+	s.mu.RLock()
+	names := map[string]string{}
+	for _, client := range s.clients[s.nextCli:] {
+		names[client.IP] = client.Name
+	}
+	for _, client := range s.clients[:s.nextCli] {
+		names[client.IP] = client.Name
+	}
+	s.mu.RUnlock()
+
+	clients := make([]Client, 0, len(names))
+	for ip, name := range names {
+		clients = append(clients, Client{IP: ip, Name: name})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].IP < clients[j].IP })
+	return clients
+}
+
+// Counts returns the running counts.
+func (s *MemoryStore) Counts() MemoryCounts {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.counts
+}
+
+// Subscribe returns a channel receiving every batch accepted from now on,
+// buffering up to buffer of them, none if buffer is negative, and a function
+// cancelling the subscription.  Batches arriving while the channel is full
+// are dropped for it.  The channel is closed on cancel or when the store is
+// closed.
+func (s *MemoryStore) Subscribe(buffer int) (<-chan Batch, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.subscribe(buffer)
+}
+
+// Follow returns the kept lookups, oldest first, and subscribes to the
+// batches accepted after them, like Subscribe.  No lookup is missed or
+// repeated between the two.
+func (s *MemoryStore) Follow(buffer int) ([]Lookup, <-chan Batch, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batches, cancel := s.subscribe(buffer)
+	return s.kept(), batches, cancel
+}
+
+// subscribe implements Subscribe.  The caller must hold s.mu.
+func (s *MemoryStore) subscribe(buffer int) (<-chan Batch, func()) {
+	if buffer < 0 {
+		buffer = 0
+	}
+	sub := make(chan Batch, buffer)
+	if s.closed {
+		close(sub)
+		return sub, func() {}
+	}
+	s.subs[sub] = struct{}{}
+	return sub, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[sub]; ok {
+			close(sub)
+			delete(s.subs, sub)
+		}
+	}
+}
+
+// LookupsHandler serves the lookups kept by s as JSON lines, oldest first.
+// With ?follow=1, it then streams the lookups of new batches until the
+// client goes away.
+func LookupsHandler(s *MemoryStore) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		var (
+			lookups []Lookup
+			batches <-chan Batch
+			cancel  = func() {}
+		)
+		follow := r.URL.Query().Get("follow") == "1"
+		if follow {
+			lookups, batches, cancel = s.Follow(16)
+		} else {
+			lookups = s.Lookups()
+		}
+		defer cancel()
+
+		enc := json.NewEncoder(rw)
+		for _, lookup := range lookups {
+			if err := enc.Encode(lookup); err != nil {
+				return
+			}
+		}
+		if !follow {
+			return
+		}
+		flusher, _ := rw.(http.Flusher)
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case batch, ok := <-batches:
+				if !ok {
+					return
+				}
+				for _, lookup := range batch.Lookups {
+					if err := enc.Encode(lookup); err != nil {
+						return
+					}
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
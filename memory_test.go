@@ -0,0 +1,171 @@
+package nsrecorder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func memoryBatch(hosts ...string) Batch {
+	batch := Batch{}
+	for _, host := range hosts {
+		batch.Lookups = append(batch.Lookups, Lookup{When: time.Unix(0, 0).UTC(), Client: "10.0.0.1", Host: host})
+	}
+	return batch
+}
+
+func memoryHosts(lookups []Lookup) []string {
+	var hosts []string
+	for _, lookup := range lookups {
+		hosts = append(hosts, lookup.Host)
+	}
+	return hosts
+}
+
+func TestMemoryStoreRing(t *testing.T) {
+	s := NewMemoryStore(3)
+	ctx := context.Background()
+	for _, batch := range []Batch{memoryBatch("a", "b"), memoryBatch("c", "d"), memoryBatch("e")} {
+		if err := s.Accept(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := memoryHosts(s.Lookups()), []string{"c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Lookups() = %q, want %q", got, want)
+	}
+	if got, want := s.Counts(), (MemoryCounts{Batches: 3, Lookups: 5}); got != want {
+		t.Errorf("Counts() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMemoryStoreClients(t *testing.T) {
+	s := NewMemoryStore(2)
+	ctx := context.Background()
+	for _, clients := range [][]Client{
+		{{IP: "10.0.0.2", Name: "phone"}, {IP: "10.0.0.1", Name: "laptop"}},
+		{{IP: "10.0.0.2", Name: "tablet"}},
+	} {
+		if err := s.Accept(ctx, Batch{Clients: clients}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []Client{{IP: "10.0.0.1", Name: "laptop"}, {IP: "10.0.0.2", Name: "tablet"}}
+	if got := s.Clients(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Clients() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMemoryStoreSubscribe(t *testing.T) {
+	s := NewMemoryStore(10)
+	ctx := context.Background()
+
+	batches, cancel := s.Subscribe(1)
+	full, _ := s.Subscribe(-1)
+	for _, host := range []string{"a", "b"} {
+		if err := s.Accept(ctx, memoryBatch(host)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batch := <-batches; !reflect.DeepEqual(memoryHosts(batch.Lookups), []string{"a"}) {
+		t.Errorf("received %+v, want lookup of a", batch)
+	}
+	// b found both channels full.
+	if n := s.Counts().Dropped; n != 3 {
+		t.Errorf("dropped %d batches, want 3", n)
+	}
+
+	cancel()
+	if _, ok := <-batches; ok {
+		t.Error("channel open after cancel")
+	}
+	cancel()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-full; ok {
+		t.Error("channel open after close")
+	}
+	late, _ := s.Subscribe(1)
+	if _, ok := <-late; ok {
+		t.Error("channel of a closed store open")
+	}
+}
+
+func TestLookupsHandler(t *testing.T) {
+	s := NewMemoryStore(10)
+	ctx := context.Background()
+	if err := s.Accept(ctx, memoryBatch("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(LookupsHandler(s))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), "{\"when\":\"1970-01-01T00:00:00Z\",\"client\":\"10.0.0.1\",\"host\":\"a\",\"type\":\"\",\"first_ip\":\"\",\"all_ips\":null,\"answers\":null}\n"+
+		"{\"when\":\"1970-01-01T00:00:00Z\",\"client\":\"10.0.0.1\",\"host\":\"b\",\"type\":\"\",\"first_ip\":\"\",\"all_ips\":null,\"answers\":null}\n"; got != want {
+		t.Errorf("served %s, want %s", got, want)
+	}
+}
+
+func TestLookupsHandlerFollow(t *testing.T) {
+	s := NewMemoryStore(10)
+	ctx := context.Background()
+	if err := s.Accept(ctx, memoryBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(LookupsHandler(s))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?follow=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	next := func() string {
+		if !lines.Scan() {
+			t.Fatalf("stream ended: %v", lines.Err())
+		}
+		lookup := Lookup{}
+		if err := json.Unmarshal(lines.Bytes(), &lookup); err != nil {
+			t.Fatal(err)
+		}
+		return lookup.Host
+	}
+
+	// Once a kept lookup is served, the handler has subscribed.
+	if host := next(); host != "a" {
+		t.Errorf("served %s, want a", host)
+	}
+	if err = s.Accept(ctx, memoryBatch("b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"b", "c"} {
+		if host := next(); host != want {
+			t.Errorf("served %s, want %s", host, want)
+		}
+	}
+
+	// Closing the store ends the stream.
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if lines.Scan() {
+		t.Errorf("served %s after close", lines.Text())
+	}
+}
@@ -1,6 +1,10 @@
 package nsrecorder // import "jw4.us/nsrecorder"
 
-import "time"
+import (
+	"strconv"
+	"strings"
+	"time"
+)
 
 // Header is the simplified structure for deserialization.
 type Header struct {
@@ -9,14 +13,16 @@ type Header struct {
 
 // Question is the simplified structure for deserialization.
 type Question struct {
-	Name string
+	Name  string
+	Qtype uint16
 }
 
 // Answer is the simplified structure for deserialization.
 type Answer struct {
-	Hdr  Header
-	A    string
-	AAAA string
+	Hdr    Header
+	A      string
+	AAAA   string
+	Target string
 }
 
 // Msg is the simplified structure for deserialization.
@@ -32,3 +38,29 @@ type Message struct {
 	Time     time.Time
 	Msg      Msg
 }
+
+var rrTypes = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 13: "HINFO", 15: "MX", 16: "TXT", 28: "AAAA",
+	33: "SRV", 35: "NAPTR", 43: "DS", 48: "DNSKEY", 64: "SVCB", 65: "HTTPS", 255: "ANY",
+}
+
+// typeName returns the mnemonic of a resource record type.
+func typeName(rrtype uint16) string {
+	if name, ok := rrTypes[rrtype]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(rrtype))
+}
+
+// typeNumber is the inverse of typeName.
+func typeNumber(name string) uint16 {
+	for rrtype, n := range rrTypes {
+		if n == name {
+			return rrtype
+		}
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(name, "TYPE")); err == nil {
+		return uint16(n)
+	}
+	return 0
+}
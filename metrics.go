@@ -0,0 +1,188 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+var (
+	sizeBuckets    = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+	secondsBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	metrics = &ingestMetrics{
+		batchSize:     newHistogram(sizeBuckets),
+		flushSeconds:  newHistogram(secondsBuckets),
+		acceptSeconds: map[string]*histogram{},
+		acceptErrors:  map[string]*counter{},
+	}
+)
+
+// MetricsHandler serves the ingestion metrics of w in the Prometheus text
+// exposition format.
+func MetricsHandler(w *Watcher) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writeTo(rw)
+		if w != nil && w.consumer != nil {
+			writeConsumerStats(rw, w.consumer.Stats())
+		}
+	})
+}
+
+type ingestMetrics struct {
+	received      counter
+	finished      counter
+	requeued      counter
+	parseErrors   counter
+	reverseHits   counter
+	reverseMisses counter
+	batchSize     *histogram
+	flushSeconds  *histogram
+
+	journalBytes    gauge
+	journalSpilled  counter
+	journalReplayed counter
+	journalRejected counter
+	journalDead     counter
+
+	queued        gauge
+	queueRejected counter
+
+	mu            sync.Mutex
+	acceptSeconds map[string]*histogram
+	acceptErrors  map[string]*counter
+}
+
+func (m *ingestMetrics) store(name string) (*histogram, *counter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.acceptSeconds[name]
+	if !ok {
+		h = newHistogram(secondsBuckets)
+		m.acceptSeconds[name] = h
+		m.acceptErrors[name] = &counter{}
+	}
+	return h, m.acceptErrors[name]
+}
+
+func (m *ingestMetrics) writeTo(w io.Writer) {
+	writeCounter(w, "nsr_messages_received_total", "Messages received from NSQ.", m.received.value())
+	writeCounter(w, "nsr_messages_finished_total", "Messages finished after a successful store.", m.finished.value())
+	writeCounter(w, "nsr_messages_requeued_total", "Messages requeued to NSQ.", m.requeued.value())
+	writeCounter(w, "nsr_parse_errors_total", "Messages that could not be parsed.", m.parseErrors.value())
+	writeCounter(w, "nsr_reverse_cache_hits_total", "Client reverse lookups answered from the cache.", m.reverseHits.value())
+	writeCounter(w, "nsr_reverse_cache_misses_total", "Client reverse lookups that missed the cache.", m.reverseMisses.value())
+
+	writeHeader(w, "nsr_batch_size", "Messages per batch.", "histogram")
+	m.batchSize.writeTo(w, "nsr_batch_size", "")
+	writeHeader(w, "nsr_flush_seconds", "Time taken to parse and store a batch.", "histogram")
+	m.flushSeconds.writeTo(w, "nsr_flush_seconds", "")
+
+	writeHeader(w, "nsr_journal_bytes", "Size of the spill journal.", "gauge")
+	fmt.Fprintf(w, "nsr_journal_bytes %d\n", m.journalBytes.value())
+	writeCounter(w, "nsr_journal_spilled_batches_total", "Batches written to the spill journal.", m.journalSpilled.value())
+	writeCounter(w, "nsr_journal_replayed_batches_total", "Batches replayed from the spill journal.", m.journalReplayed.value())
+	writeCounter(w, "nsr_journal_rejected_batches_total", "Batches rejected because the spill journal was full.", m.journalRejected.value())
+	writeCounter(w, "nsr_journal_dead_batches_total", "Journaled batches moved to the dead-letter file after failing to replay.", m.journalDead.value())
+
+	writeHeader(w, "nsr_queued_batches", "Batches waiting in store queues.", "gauge")
+	fmt.Fprintf(w, "nsr_queued_batches %d\n", m.queued.value())
+	writeCounter(w, "nsr_queue_rejected_batches_total", "Batches rejected because a store queue was full.", m.queueRejected.value())
+
+	m.mu.Lock()
+	names := make([]string, 0, len(m.acceptSeconds))
+	for name := range m.acceptSeconds {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+
+	writeHeader(w, "nsr_store_accept_seconds", "Time taken by Store.Accept.", "histogram")
+	for _, name := range names {
+		h, _ := m.store(name)
+		h.writeTo(w, "nsr_store_accept_seconds", fmt.Sprintf("store=%q", name))
+	}
+	writeHeader(w, "nsr_store_accept_errors_total", "Errors returned by Store.Accept.", "counter")
+	for _, name := range names {
+		_, c := m.store(name)
+		fmt.Fprintf(w, "nsr_store_accept_errors_total{store=%q} %d\n", name, c.value())
+	}
+}
+
+func writeConsumerStats(w io.Writer, stats *nsq.ConsumerStats) {
+	writeCounter(w, "nsr_nsq_messages_received_total", "Messages received as reported by the NSQ consumer.", stats.MessagesReceived)
+	writeCounter(w, "nsr_nsq_messages_finished_total", "Messages finished as reported by the NSQ consumer.", stats.MessagesFinished)
+	writeCounter(w, "nsr_nsq_messages_requeued_total", "Messages requeued as reported by the NSQ consumer.", stats.MessagesRequeued)
+	writeHeader(w, "nsr_nsq_connections", "Open connections to nsqd.", "gauge")
+	fmt.Fprintf(w, "nsr_nsq_connections %d\n", stats.Connections)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(w io.Writer, name, help string, value uint64) {
+	writeHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+type counter struct{ v uint64 }
+
+func (c *counter) inc()          { c.add(1) }
+func (c *counter) add(n uint64)  { atomic.AddUint64(&c.v, n) }
+func (c *counter) value() uint64 { return atomic.LoadUint64(&c.v) }
+
+type gauge struct{ v int64 }
+
+func (g *gauge) set(n int64)  { atomic.StoreInt64(&g.v, n) }
+func (g *gauge) add(n int64)  { atomic.AddInt64(&g.v, n) }
+func (g *gauge) value() int64 { return atomic.LoadInt64(&g.v) }
+
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for x, bound := range h.bounds {
+		if v <= bound {
+			h.counts[x]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prefix := ""
+	if labels != "" {
+		prefix = labels + ","
+	}
+	for x, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[x])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
@@ -0,0 +1,256 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+var ErrSchemaTooNew = errors.New("db schema is newer than this version of nsr")
+
+// migration upgrades the sqlite schema by one version.  The statements are
+// executed before apply, in the same transaction.
+type migration struct {
+	description string
+	statements  []string
+	apply       func(*sql.Tx) error
+}
+
+// migrations are applied in order.  The schema version of a db, kept in
+// PRAGMA user_version, is the number of migrations applied to it.  Never
+// edit or reorder a released migration; append a new one.
+var migrations = []migration{
+	{
+		description: "create lookups, clients and reverse tables",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS lookups (evt TEXT NOT NULL, clientip TEXT NOT NULL, host TEXT NOT NULL, PRIMARY KEY(evt, clientip, host) ON CONFLICT REPLACE)",
+			"CREATE TABLE IF NOT EXISTS clients (ip  TEXT NOT NULL, name     TEXT NOT NULL, PRIMARY KEY(ip, name) ON CONFLICT REPLACE)",
+			"CREATE TABLE IF NOT EXISTS reverse (ip  TEXT NOT NULL, name     TEXT NOT NULL, PRIMARY KEY(ip, name) ON CONFLICT REPLACE)",
+		},
+	},
+	{
+		// lookups.ts is in nanoseconds since the unix epoch.
+		description: "intern hosts and clients, store integer timestamps and answers",
+		statements: []string{
+			"CREATE TABLE hosts (id INTEGER PRIMARY KEY, name TEXT NOT NULL UNIQUE)",
+			"ALTER TABLE clients RENAME TO clients_v1",
+			"CREATE TABLE clients (id INTEGER PRIMARY KEY, ip TEXT NOT NULL UNIQUE, name TEXT NOT NULL)",
+			"ALTER TABLE lookups RENAME TO lookups_v1",
+			"CREATE TABLE lookups (id INTEGER PRIMARY KEY, ts INTEGER NOT NULL, client_id INTEGER NOT NULL REFERENCES clients (id), host_id INTEGER NOT NULL REFERENCES hosts (id), UNIQUE (ts, client_id, host_id))",
+			"CREATE TABLE answers (lookup_id INTEGER NOT NULL REFERENCES lookups (id), ip TEXT NOT NULL, PRIMARY KEY (lookup_id, ip)) WITHOUT ROWID",
+			"CREATE INDEX lookups_host_ts ON lookups (host_id, ts)",
+			"CREATE INDEX lookups_client_ts ON lookups (client_id, ts)",
+			"CREATE INDEX answers_ip ON answers (ip)",
+			"INSERT INTO clients (ip, name) SELECT ip, max(name) FROM clients_v1 GROUP BY ip",
+			"INSERT OR IGNORE INTO clients (ip, name) SELECT DISTINCT clientip, clientip FROM lookups_v1",
+			"INSERT OR IGNORE INTO hosts (name) SELECT DISTINCT host FROM lookups_v1",
+		},
+		apply: func(tx *sql.Tx) error {
+			if err := convertLookupsV1(tx); err != nil {
+				return err
+			}
+			for _, statement := range []string{"DROP TABLE lookups_v1", "DROP TABLE clients_v1"} {
+				if _, err := tx.Exec(statement); err != nil {
+					return errors.Wrapf(err, "executing %q", statement)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// pdns aggregates the answers seen for every (rrname, rrtype, rdata),
+		// with time_first and time_last in nanoseconds since the unix epoch.
+		description: "create pdns aggregate",
+		statements: []string{
+			"CREATE TABLE pdns (rrname TEXT NOT NULL, rrtype TEXT NOT NULL, rdata TEXT NOT NULL, time_first INTEGER NOT NULL, time_last INTEGER NOT NULL, count INTEGER NOT NULL, PRIMARY KEY (rrname, rrtype, rdata)) WITHOUT ROWID",
+			"CREATE INDEX pdns_rdata ON pdns (rdata)",
+			"INSERT INTO pdns (rrname, rrtype, rdata, time_first, time_last, count) " +
+				"SELECT h.name, CASE WHEN instr(a.ip, ':') > 0 THEN 'AAAA' ELSE 'A' END, a.ip, min(l.ts), max(l.ts), count(*) " +
+				"FROM answers a JOIN lookups l ON l.id = a.lookup_id JOIN hosts h ON h.id = l.host_id GROUP BY 1, 2, 3",
+		},
+	},
+	{
+		// client_names holds the spans, in nanoseconds since the unix epoch,
+		// during which a client ip resolved to a name.
+		description: "create client name history",
+		statements: []string{
+			"CREATE TABLE client_names (ip TEXT NOT NULL, name TEXT NOT NULL, first_seen INTEGER NOT NULL, last_seen INTEGER NOT NULL, PRIMARY KEY (ip, first_seen)) WITHOUT ROWID",
+			"INSERT INTO client_names (ip, name, first_seen, last_seen) " +
+				"SELECT c.ip, c.name, min(l.ts), max(l.ts) FROM clients c JOIN lookups l ON l.client_id = c.id GROUP BY c.id",
+		},
+	},
+	{
+		// The rollup buckets are the start of the hour or UTC day, in
+		// nanoseconds since the unix epoch.
+		description: "record query types and create hourly and daily rollups",
+		statements: []string{
+			"ALTER TABLE lookups ADD COLUMN qtype TEXT NOT NULL DEFAULT ''",
+			"CREATE TABLE rollup_hourly (bucket INTEGER NOT NULL, client_id INTEGER NOT NULL REFERENCES clients (id), host_id INTEGER NOT NULL REFERENCES hosts (id), qtype TEXT NOT NULL, count INTEGER NOT NULL, PRIMARY KEY (bucket, client_id, host_id, qtype)) WITHOUT ROWID",
+			"CREATE TABLE rollup_daily (bucket INTEGER NOT NULL, client_id INTEGER NOT NULL REFERENCES clients (id), host_id INTEGER NOT NULL REFERENCES hosts (id), qtype TEXT NOT NULL, count INTEGER NOT NULL, PRIMARY KEY (bucket, client_id, host_id, qtype)) WITHOUT ROWID",
+			"CREATE INDEX lookups_ts ON lookups (ts)",
+			"INSERT INTO rollup_hourly (bucket, client_id, host_id, qtype, count) " +
+				"SELECT ts - ts % 3600000000000, client_id, host_id, qtype, count(*) FROM lookups GROUP BY 1, 2, 3, 4",
+			"INSERT INTO rollup_daily (bucket, client_id, host_id, qtype, count) " +
+				"SELECT ts - ts % 86400000000000, client_id, host_id, qtype, count(*) FROM lookups GROUP BY 1, 2, 3, 4",
+		},
+	},
+}
+
+// SchemaStatus describes the schema of a sqlite db.
+type SchemaStatus struct {
+	// Version is the schema version of the db before any migration.
+	Version int
+	// Latest is the schema version this version of nsr writes.
+	Latest int
+	// Pending describes the migrations Version is missing.
+	Pending []string
+	// Applied describes the migrations that were applied.
+	Applied []string
+}
+
+// MigrateSQLite applies the pending migrations to the sqlite db at path, or
+// only reports them if dryRun is set.
+func MigrateSQLite(path string, opts SQLiteOptions, dryRun bool) (SchemaStatus, error) {
+	if _, err := os.Stat(path); err != nil {
+		return SchemaStatus{}, errors.Wrap(err, "checking sqlite db")
+	}
+	db, err := openSQLiteDB(path, opts)
+	if err != nil {
+		return SchemaStatus{}, errors.Wrap(err, "opening sqlite3 db connection")
+	}
+	defer db.Close()
+
+	if dryRun {
+		return schemaStatus(db)
+	}
+	return migrate(db)
+}
+
+func schemaStatus(db *sql.DB) (SchemaStatus, error) {
+	status := SchemaStatus{Latest: len(migrations)}
+	if err := db.QueryRow("PRAGMA user_version").Scan(&status.Version); err != nil {
+		return status, errors.Wrap(err, "reading schema version")
+	}
+	if status.Version > status.Latest {
+		return status, errors.Wrapf(ErrSchemaTooNew, "version %d, latest known %d", status.Version, status.Latest)
+	}
+	for _, m := range migrations[status.Version:] {
+		status.Pending = append(status.Pending, m.description)
+	}
+	return status, nil
+}
+
+// checkSchema returns an error unless db has the latest schema.
+func checkSchema(db *sql.DB) error {
+	status, err := schemaStatus(db)
+	if err != nil {
+		return err
+	}
+	if status.Version < status.Latest {
+		return errors.Errorf("db schema version %d is older than %d, run nsr migrate", status.Version, status.Latest)
+	}
+	return nil
+}
+
+func migrate(db *sql.DB) (SchemaStatus, error) {
+	status, err := schemaStatus(db)
+	if err != nil {
+		return status, err
+	}
+	for version := status.Version; version < status.Latest; version++ {
+		m := migrations[version]
+		applied, err := applyMigration(db, version+1, m)
+		if err != nil {
+			return status, errors.Wrapf(err, "migrating to version %d (%s)", version+1, m.description)
+		}
+		if !applied {
+			continue
+		}
+		logger.Info("migrated schema", "store", "sqlite", "version", version+1, "migration", m.description)
+		status.Applied = append(status.Applied, m.description)
+	}
+	return status, nil
+}
+
+// applyMigration applies m and sets the schema version to version, unless
+// another process already did.  The transaction takes the write lock as it
+// begins, so the version read under it can not change before the commit.
+func applyMigration(db *sql.DB, version int, m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "beginning transaction")
+	}
+	var current int
+	if err = tx.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		_ = tx.Rollback()
+		return false, errors.Wrap(err, "reading schema version")
+	}
+	if current >= version {
+		return false, errors.Wrap(tx.Rollback(), "rolling back migration")
+	}
+	for _, statement := range m.statements {
+		if _, err = tx.Exec(statement); err != nil {
+			_ = tx.Rollback()
+			return false, errors.Wrapf(err, "executing %q", statement)
+		}
+	}
+	if m.apply != nil {
+		if err = m.apply(tx); err != nil {
+			_ = tx.Rollback()
+			return false, err
+		}
+	}
+	// PRAGMA does not take parameters; version is always a plain integer.
+	if _, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(version)); err != nil {
+		_ = tx.Rollback()
+		return false, errors.Wrap(err, "setting schema version")
+	}
+	return true, errors.Wrap(tx.Commit(), "committing migration")
+}
+
+// convertLookupsV1 copies lookups_v1 into lookups, converting the timestamps
+// the driver stored as text.
+func convertLookupsV1(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT l.evt, c.id, h.id FROM lookups_v1 l JOIN clients c ON c.ip = l.clientip JOIN hosts h ON h.name = l.host")
+	if err != nil {
+		return errors.Wrap(err, "querying lookups_v1")
+	}
+	defer rows.Close()
+
+	insert, err := tx.Prepare("INSERT OR IGNORE INTO lookups (ts, client_id, host_id) VALUES (?, ?, ?)")
+	if err != nil {
+		return errors.Wrap(err, "preparing insert lookups")
+	}
+	defer insert.Close()
+
+	for rows.Next() {
+		var (
+			evt              string
+			clientID, hostID int64
+		)
+		if err = rows.Scan(&evt, &clientID, &hostID); err != nil {
+			return errors.Wrap(err, "scanning lookups_v1")
+		}
+		when, err := parseTimestamp(evt)
+		if err != nil {
+			return err
+		}
+		if _, err = insert.Exec(when.UnixNano(), clientID, hostID); err != nil {
+			return errors.Wrap(err, "inserting lookup")
+		}
+	}
+	return errors.Wrap(rows.Err(), "reading lookups_v1")
+}
+
+func parseTimestamp(s string) (time.Time, error) {
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("unrecognized timestamp %q", s)
+}
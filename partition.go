@@ -0,0 +1,569 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxOpenPartitions is the number of partitions kept open between batches
+// and queries, besides the current one; the others are reopened when used.
+const maxOpenPartitions = 3
+
+var ErrUnknownPartition = errors.New("unknown partition period")
+
+// partitioning splits time into the periods held by the files of a
+// partitioned sqlite db: "day", "week" (ISO weeks) or "month", in UTC.
+type partitioning string
+
+func (p partitioning) valid() bool {
+	return p == "day" || p == "week" || p == "month"
+}
+
+// start returns the start of the period holding t.
+func (p partitioning) start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch p {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day
+}
+
+// next returns the start of the period following the one starting at start.
+func (p partitioning) next(start time.Time) time.Time {
+	switch p {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// key names the period starting at start: 2006-01-02, 2006-W01 or 2006-01.
+func (p partitioning) key(start time.Time) string {
+	switch p {
+	case "week":
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case "month":
+		return start.Format("2006-01")
+	}
+	return start.Format("2006-01-02")
+}
+
+// parse returns the start of the period named key.
+func (p partitioning) parse(key string) (time.Time, bool) {
+	var (
+		start time.Time
+		err   error
+	)
+	switch p {
+	case "week":
+		var year, week int
+		if _, err = fmt.Sscanf(key, "%04d-W%02d", &year, &week); err == nil {
+			// The first ISO week of a year holds January 4th.
+			start = p.start(time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC)).AddDate(0, 0, 7*(week-1))
+		}
+	case "month":
+		start, err = time.Parse("2006-01", key)
+	default:
+		start, err = time.Parse("2006-01-02", key)
+	}
+	return start, err == nil && p.key(start) == key
+}
+
+// newPartitionedStore returns a sqlite store keeping the lookups of every
+// period in its own db, named after path with the key of the period before
+// the extension: nsr.db holds nsr-2006-01.db, nsr-2006-02.db and so on.
+func newPartitionedStore(path string, opts SQLiteOptions) *partitionedStore {
+	ext := filepath.Ext(path)
+	return &partitionedStore{
+		base:   strings.TrimSuffix(path, ext),
+		ext:    ext,
+		p:      partitioning(opts.Partition),
+		opts:   opts,
+		stores: map[string]*sqliteStore{},
+	}
+}
+
+type partitionedStore struct {
+	base string
+	ext  string
+	p    partitioning
+	opts SQLiteOptions
+
+	mu     sync.Mutex
+	stores map[string]*sqliteStore
+	// current is the key of the current partition, which stays open.
+	current string
+	// used holds the keys of the other partitions kept open, least
+	// recently used first.
+	used []string
+	// pruned holds the keys of the partitions past every retention that
+	// have been pruned, and have not been written to since.
+	pruned map[string]bool
+}
+
+func (s *partitionedStore) path(start time.Time) string {
+	return s.base + "-" + s.p.key(start) + s.ext
+}
+
+// partition returns the store of the period starting at start, closing the
+// least recently used ones beyond maxOpenPartitions.  The current partition
+// is never closed, so that reading or pruning old partitions does not make
+// the next batch reopen it.  Closed stores are kept, and reopen when they
+// are used again.
+func (s *partitionedStore) partition(start time.Time) *sqliteStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.p.key(start)
+	store, ok := s.stores[key]
+	if !ok {
+		store = &sqliteStore{path: s.path(start), opts: s.opts}
+		s.stores[key] = store
+	}
+	if current := s.p.key(s.p.start(time.Now())); current != s.current {
+		// The previous current partition ages out like the others.
+		if s.current != "" {
+			if _, ok := s.stores[s.current]; ok {
+				s.used = append(s.used, s.current)
+			}
+		}
+		s.current = current
+		s.forget(current)
+	}
+	s.forget(key)
+	if key != s.current {
+		s.used = append(s.used, key)
+	}
+	for len(s.used) > maxOpenPartitions {
+		if err := s.stores[s.used[0]].Close(); err != nil {
+			logger.Warn("closing partition", "store", "sqlite", "db", s.stores[s.used[0]].path, "error", err)
+		}
+		s.used = s.used[1:]
+	}
+	return store
+}
+
+// forget removes key from the partitions kept open by least recent use.
+func (s *partitionedStore) forget(key string) {
+	for x, used := range s.used {
+		if used == key {
+			s.used = append(s.used[:x], s.used[x+1:]...)
+			return
+		}
+	}
+}
+
+// partitions returns the start of every existing partition overlapping the
+// range of q, newest first.
+func (s *partitionedStore) partitions(q Query) ([]time.Time, error) {
+	if !s.p.valid() {
+		return nil, errors.Wrapf(ErrUnknownPartition, "%q", s.p)
+	}
+	paths, err := filepath.Glob(s.base + "-*" + s.ext)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing partitions")
+	}
+	var starts []time.Time
+	for _, path := range paths {
+		start, ok := s.p.parse(strings.TrimSuffix(strings.TrimPrefix(path, s.base+"-"), s.ext))
+		if !ok {
+			continue
+		}
+		if !q.From.IsZero() && !s.p.next(start).After(q.From) || !q.To.IsZero() && !start.Before(q.To) {
+			continue
+		}
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].After(starts[j]) })
+	return starts, nil
+}
+
+// Accept writes the lookups of every period to its partition, with the
+// clients of the batch.  A batch without lookups goes to the current
+// partition.  A failing partition fails the batch, even though the
+// partitions before it accepted their lookups.
+func (s *partitionedStore) Accept(ctx context.Context, batch Batch) error {
+	groups := map[time.Time][]Lookup{}
+	for _, lookup := range batch.Lookups {
+		start := s.p.start(lookup.When)
+		groups[start] = append(groups[start], lookup)
+	}
+	if len(groups) == 0 {
+		groups[s.p.start(time.Now())] = nil
+	}
+	starts := make([]time.Time, 0, len(groups))
+	for start := range groups {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	for _, start := range starts {
+		if !s.p.valid() {
+			return errors.Wrapf(ErrUnknownPartition, "%q", s.p)
+		}
+		if err := s.partition(start).Accept(ctx, Batch{Clients: batch.Clients, Lookups: groups[start]}); err != nil {
+			return errors.Wrapf(err, "partition %s", s.p.key(start))
+		}
+		if len(groups[start]) > 0 {
+			s.mu.Lock()
+			delete(s.pruned, s.p.key(start))
+			s.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (s *partitionedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for key, store := range s.stores {
+		if cerr := store.Close(); err == nil {
+			err = cerr
+		}
+		delete(s.stores, key)
+	}
+	s.current, s.used = "", nil
+	return err
+}
+
+// Healthy opens and initializes the current partition.
+func (s *partitionedStore) Healthy(ctx context.Context) error {
+	if !s.p.valid() {
+		return errors.Wrapf(ErrUnknownPartition, "%q", s.p)
+	}
+	return s.partition(s.p.start(time.Now())).Healthy(ctx)
+}
+
+// Prune deletes the partitions whose whole period is older than every
+// retention, if none keeps data forever, and prunes the rows of the
+// remaining partitions as a single db would.  A partition past every set
+// retention is left alone once pruned, until lookups are written to it.
+// Files are never deleted while any retention is unset: keeping the daily
+// rollups, sightings or client names forever keeps every partition, each
+// shrunk to what those retentions keep.
+func (s *partitionedStore) Prune(ctx context.Context, policy RetentionPolicy, now time.Time) (PruneResult, error) {
+	result := PruneResult{}
+	if policy == (RetentionPolicy{}) {
+		return result, nil
+	}
+	var shortest, longest time.Duration
+	removable := true
+	for _, retention := range []time.Duration{policy.Lookups, policy.Hourly, policy.Daily, policy.PDNS, policy.ClientNames} {
+		if retention > 0 && (shortest == 0 || retention < shortest) {
+			shortest = retention
+		}
+		if retention > longest {
+			longest = retention
+		}
+		// Whole partitions can only go once every kind of data has
+		// expired.
+		removable = removable && retention > 0
+	}
+
+	starts, err := s.partitions(Query{To: now.Add(-shortest)})
+	if err != nil {
+		return result, err
+	}
+	for _, start := range starts {
+		key := s.p.key(start)
+		expired := !s.p.next(start).After(now.Add(-longest))
+		if expired && removable {
+			if err = s.remove(start); err != nil {
+				return result, err
+			}
+			result.Partitions++
+			continue
+		}
+		if expired && s.wasPruned(key) {
+			continue
+		}
+		pruned, err := s.partition(start).Prune(ctx, policy, now)
+		result.Lookups += pruned.Lookups
+		result.Hourly += pruned.Hourly
+		result.Daily += pruned.Daily
+		result.Related += pruned.Related
+		if err != nil {
+			return result, errors.Wrapf(err, "partition %s", key)
+		}
+		if expired {
+			s.mu.Lock()
+			if s.pruned == nil {
+				s.pruned = map[string]bool{}
+			}
+			s.pruned[key] = true
+			s.mu.Unlock()
+		}
+	}
+	return result, nil
+}
+
+// wasPruned reports whether the partition named key is past every retention
+// and has been pruned since it was last written to.
+func (s *partitionedStore) wasPruned(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pruned[key]
+}
+
+// remove closes and deletes the partition starting at start.
+func (s *partitionedStore) remove(start time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.p.key(start)
+	if store, ok := s.stores[key]; ok {
+		_ = store.Close()
+		delete(s.stores, key)
+		s.forget(key)
+	}
+	delete(s.pruned, key)
+	path := s.path(start)
+	for _, suffix := range []string{"-wal", "-shm", ""} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "removing partition")
+		}
+	}
+	logger.Info("removed partition", "store", "sqlite", "db", path)
+	return nil
+}
+
+func (s *partitionedStore) LookupsByHost(ctx context.Context, host string, q Query) ([]Lookup, error) {
+	return s.lookups(q, func(store *sqliteStore, q Query) ([]Lookup, error) { return store.LookupsByHost(ctx, host, q) })
+}
+
+func (s *partitionedStore) LookupsByClient(ctx context.Context, ip string, q Query) ([]Lookup, error) {
+	return s.lookups(q, func(store *sqliteStore, q Query) ([]Lookup, error) { return store.LookupsByClient(ctx, ip, q) })
+}
+
+// lookups reads the partitions newest first until the page of q is filled.
+// Every lookup is in the partition of its time, so the partitions hold
+// consecutive runs of the results.
+func (s *partitionedStore) lookups(q Query, read func(*sqliteStore, Query) ([]Lookup, error)) ([]Lookup, error) {
+	starts, err := s.partitions(q)
+	if err != nil {
+		return nil, err
+	}
+	var lookups []Lookup
+	for _, start := range starts {
+		part := Query{From: q.From, To: q.To}
+		if q.Limit > 0 {
+			if len(lookups) >= q.Offset+q.Limit {
+				break
+			}
+			part.Limit = q.Offset + q.Limit - len(lookups)
+		}
+		found, err := read(s.partition(start), part)
+		if err != nil {
+			return nil, err
+		}
+		lookups = append(lookups, found...)
+	}
+	from, to := page(len(lookups), q)
+	return lookups[from:to], nil
+}
+
+func (s *partitionedStore) HostsForIP(ctx context.Context, ip string, q Query) ([]Sighting, error) {
+	return s.sightings(q, func(store *sqliteStore, q Query) ([]Sighting, error) { return store.HostsForIP(ctx, ip, q) })
+}
+
+func (s *partitionedStore) IPsForHost(ctx context.Context, host string, q Query) ([]Sighting, error) {
+	return s.sightings(q, func(store *sqliteStore, q Query) ([]Sighting, error) { return store.IPsForHost(ctx, host, q) })
+}
+
+// sightings merges the sightings of a record in every partition.
+func (s *partitionedStore) sightings(q Query, read func(*sqliteStore, Query) ([]Sighting, error)) ([]Sighting, error) {
+	starts, err := s.partitions(q)
+	if err != nil {
+		return nil, err
+	}
+	merged := map[Record]*Sighting{}
+	var sightings []*Sighting
+	for _, start := range starts {
+		found, err := read(s.partition(start), Query{From: q.From, To: q.To})
+		if err != nil {
+			return nil, err
+		}
+		for x := range found {
+			sighting := &found[x]
+			key := Record{Name: sighting.Name, Type: sighting.Type, Data: sighting.Data}
+			seen, ok := merged[key]
+			if !ok {
+				merged[key] = sighting
+				sightings = append(sightings, sighting)
+				continue
+			}
+			if sighting.FirstSeen.Before(seen.FirstSeen) {
+				seen.FirstSeen = sighting.FirstSeen
+			}
+			if sighting.LastSeen.After(seen.LastSeen) {
+				seen.LastSeen = sighting.LastSeen
+			}
+			seen.Count += sighting.Count
+		}
+	}
+	sort.SliceStable(sightings, func(i, j int) bool { return sightings[i].LastSeen.After(sightings[j].LastSeen) })
+
+	from, to := page(len(sightings), q)
+	result := make([]Sighting, 0, to-from)
+	for _, sighting := range sightings[from:to] {
+		result = append(result, *sighting)
+	}
+	return result, nil
+}
+
+// TopHosts adds up the counts of every partition.
+func (s *partitionedStore) TopHosts(ctx context.Context, q Query) ([]HostCount, error) {
+	starts, err := s.partitions(hourly(q))
+	if err != nil {
+		return nil, err
+	}
+	totals := map[string]int64{}
+	for _, start := range starts {
+		counts, err := s.partition(start).TopHosts(ctx, Query{From: q.From, To: q.To})
+		if err != nil {
+			return nil, err
+		}
+		for _, count := range counts {
+			totals[count.Host] += count.Count
+		}
+	}
+	counts := make([]HostCount, 0, len(totals))
+	for host, count := range totals {
+		counts = append(counts, HostCount{Host: host, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Host < counts[j].Host
+	})
+	from, to := page(len(counts), q)
+	return counts[from:to], nil
+}
+
+// TopClients adds up the counts of every partition, naming clients as the
+// newest partition does.
+func (s *partitionedStore) TopClients(ctx context.Context, q Query) ([]ClientCount, error) {
+	starts, err := s.partitions(hourly(q))
+	if err != nil {
+		return nil, err
+	}
+	totals := map[string]*ClientCount{}
+	for _, start := range starts {
+		counts, err := s.partition(start).TopClients(ctx, Query{From: q.From, To: q.To})
+		if err != nil {
+			return nil, err
+		}
+		for x, count := range counts {
+			if total, ok := totals[count.IP]; ok {
+				total.Count += count.Count
+			} else {
+				totals[count.IP] = &counts[x]
+			}
+		}
+	}
+	counts := make([]ClientCount, 0, len(totals))
+	for _, count := range totals {
+		counts = append(counts, *count)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].IP < counts[j].IP
+	})
+	from, to := page(len(counts), q)
+	return counts[from:to], nil
+}
+
+// SearchHosts merges the hosts matching pattern in every partition.
+func (s *partitionedStore) SearchHosts(ctx context.Context, pattern string, q Query) ([]string, error) {
+	starts, err := s.partitions(q)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var hosts []string
+	for _, start := range starts {
+		found, err := s.partition(start).SearchHosts(ctx, pattern, Query{From: q.From, To: q.To})
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range found {
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	from, to := page(len(hosts), q)
+	return hosts[from:to], nil
+}
+
+func (s *partitionedStore) ClientAt(ip string, at time.Time) (ClientSpan, error) {
+	spans, err := s.ClientSpans(ip)
+	if err != nil {
+		return ClientSpan{}, err
+	}
+	for x := len(spans) - 1; x >= 0; x-- {
+		if !spans[x].FirstSeen.After(at) {
+			return spans[x], nil
+		}
+	}
+	return ClientSpan{}, errors.Wrapf(ErrNotFound, "client %s at %v", ip, at)
+}
+
+// ClientSpans joins the spans of every partition, merging the spans of a
+// name that continue into the next partition.
+func (s *partitionedStore) ClientSpans(ip string) ([]ClientSpan, error) {
+	starts, err := s.partitions(Query{})
+	if err != nil {
+		return nil, err
+	}
+	var spans []ClientSpan
+	for x := len(starts) - 1; x >= 0; x-- {
+		found, err := s.partition(starts[x]).ClientSpans(ip)
+		if err != nil {
+			return nil, err
+		}
+		for _, span := range found {
+			if last := len(spans) - 1; last >= 0 && spans[last].Name == span.Name {
+				spans[last].LastSeen = span.LastSeen
+				continue
+			}
+			spans = append(spans, span)
+		}
+	}
+	return spans, nil
+}
+
+// page returns the bounds of the page of q among n results.
+func page(n int, q Query) (int, int) {
+	from := q.Offset
+	if from > n {
+		from = n
+	}
+	to := n
+	if q.Limit > 0 && from+q.Limit < n {
+		to = from + q.Limit
+	}
+	return from, to
+}
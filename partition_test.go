@@ -0,0 +1,274 @@
+package nsrecorder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPartitioning(t *testing.T) {
+	for _, tc := range []struct {
+		p     partitioning
+		t     time.Time
+		start time.Time
+		key   string
+		next  time.Time
+	}{
+		{"day", time.Date(2026, 3, 15, 23, 59, 0, 0, time.UTC), date(2026, 3, 15), "2026-03-15", date(2026, 3, 16)},
+		{"day", time.Date(2027, 1, 1, 1, 0, 0, 0, time.FixedZone("CEST", 2*3600)), date(2026, 12, 31), "2026-12-31", date(2027, 1, 1)},
+		{"week", time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC), date(2026, 3, 9), "2026-W11", date(2026, 3, 16)},
+		// Thursday the 31st of December 2020 is in week 53 of 2020, and so
+		// is Sunday the 3rd of January 2021.
+		{"week", date(2020, 12, 31), date(2020, 12, 28), "2020-W53", date(2021, 1, 4)},
+		{"week", date(2021, 1, 3), date(2020, 12, 28), "2020-W53", date(2021, 1, 4)},
+		{"week", date(2021, 1, 4), date(2021, 1, 4), "2021-W01", date(2021, 1, 11)},
+		// Monday the 30th of December 2024 starts week 1 of 2025.
+		{"week", date(2024, 12, 31), date(2024, 12, 30), "2025-W01", date(2025, 1, 6)},
+		{"month", time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC), date(2026, 12, 1), "2026-12", date(2027, 1, 1)},
+		{"month", date(2026, 1, 1), date(2026, 1, 1), "2026-01", date(2026, 2, 1)},
+	} {
+		start := tc.p.start(tc.t)
+		if !start.Equal(tc.start) {
+			t.Errorf("%s start(%s) = %s, want %s", tc.p, tc.t, start, tc.start)
+		}
+		if key := tc.p.key(start); key != tc.key {
+			t.Errorf("%s key(%s) = %s, want %s", tc.p, start, key, tc.key)
+		}
+		if next := tc.p.next(start); !next.Equal(tc.next) {
+			t.Errorf("%s next(%s) = %s, want %s", tc.p, start, next, tc.next)
+		}
+		if parsed, ok := tc.p.parse(tc.key); !ok || !parsed.Equal(tc.start) {
+			t.Errorf("%s parse(%s) = %s, %v, want %s", tc.p, tc.key, parsed, ok, tc.start)
+		}
+	}
+
+	for _, tc := range []struct {
+		p   partitioning
+		key string
+	}{
+		{"day", "2026-02-30"},
+		{"day", "2026-3-5"},
+		{"week", "2021-W53"},
+		{"week", "2026-W00"},
+		{"week", "2026-03"},
+		{"month", "2026-13"},
+		{"month", "2026-03-01"},
+	} {
+		if parsed, ok := tc.p.parse(tc.key); ok {
+			t.Errorf("%s parse(%s) = %s, want no period", tc.p, tc.key, parsed)
+		}
+	}
+}
+
+// partitionTestStore returns a daily partitioned store in a new directory,
+// holding a lookup of example.com by 10.0.0.1 at every one of whens.
+func partitionTestStore(t *testing.T, whens ...time.Time) (*partitionedStore, string, func()) {
+	dir, err := ioutil.TempDir("", "nsr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newPartitionedStore(filepath.Join(dir, "nsr.db"), SQLiteOptions{Partition: "day"})
+	cleanup := func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+	batch := Batch{}
+	for _, when := range whens {
+		batch.Lookups = append(batch.Lookups, Lookup{When: when, Client: "10.0.0.1", Host: "example.com", Type: "A", AllIPs: []string{"192.0.2.1"}})
+	}
+	if err = s.Accept(context.Background(), batch); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return s, dir, cleanup
+}
+
+func TestPartitionsOverlapping(t *testing.T) {
+	s, dir, cleanup := partitionTestStore(t, date(2026, 3, 1), date(2026, 3, 2).Add(time.Hour), date(2026, 3, 4))
+	defer cleanup()
+	for _, name := range []string{"nsr-backup.db", "nsr-2026-03.db", "other-2026-03-03.db"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		q    Query
+		want []time.Time
+	}{
+		{Query{}, []time.Time{date(2026, 3, 4), date(2026, 3, 2), date(2026, 3, 1)}},
+		{Query{From: date(2026, 3, 2)}, []time.Time{date(2026, 3, 4), date(2026, 3, 2)}},
+		// A range ending at midnight does not reach the next day.
+		{Query{To: date(2026, 3, 2)}, []time.Time{date(2026, 3, 1)}},
+		{Query{From: date(2026, 3, 1).Add(23 * time.Hour), To: date(2026, 3, 2).Add(time.Minute)}, []time.Time{date(2026, 3, 2), date(2026, 3, 1)}},
+		{Query{From: date(2026, 3, 5)}, nil},
+	} {
+		starts, err := s.partitions(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(starts, tc.want) {
+			t.Errorf("partitions(%+v) = %v, want %v", tc.q, starts, tc.want)
+		}
+	}
+}
+
+func TestPartitionedLookupsPaging(t *testing.T) {
+	var whens []time.Time
+	for day := 1; day <= 3; day++ {
+		whens = append(whens, date(2026, 3, day).Add(time.Hour), date(2026, 3, day).Add(2*time.Hour))
+	}
+	s, _, cleanup := partitionTestStore(t, whens...)
+	defer cleanup()
+
+	ctx := context.Background()
+	all, err := s.LookupsByHost(ctx, "example.com", Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(whens) {
+		t.Fatalf("read %d lookups, want %d", len(all), len(whens))
+	}
+	for x := range all {
+		if want := whens[len(whens)-1-x]; !all[x].When.Equal(want) {
+			t.Errorf("lookup %d at %s, want %s", x, all[x].When, want)
+		}
+	}
+
+	for _, q := range []Query{
+		{Limit: 2},
+		{Limit: 2, Offset: 1},
+		{Limit: 3, Offset: 2},
+		{Limit: 10, Offset: 4},
+		{Offset: 5},
+		{Limit: 2, Offset: 6},
+		{From: date(2026, 3, 2), Limit: 3, Offset: 1},
+	} {
+		got, err := s.LookupsByHost(ctx, "example.com", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := all
+		if !q.From.IsZero() {
+			want = all[:4]
+		}
+		from, to := page(len(want), q)
+		if !reflect.DeepEqual(got, want[from:to]) {
+			t.Errorf("LookupsByHost(%+v) = %v, want %v", q, got, want[from:to])
+		}
+	}
+}
+
+func TestPartitionLRU(t *testing.T) {
+	now := time.Now()
+	s, _, cleanup := partitionTestStore(t, now)
+	defer cleanup()
+	current := s.p.key(s.p.start(now))
+
+	ctx := context.Background()
+	var old []string
+	for day := 1; day <= maxOpenPartitions+2; day++ {
+		when := now.AddDate(0, 0, -day)
+		old = append(old, s.p.key(s.p.start(when)))
+		if err := s.Accept(ctx, Batch{Lookups: []Lookup{{When: when, Client: "10.0.0.1", Host: "example.com", Type: "A"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.current != current {
+		t.Errorf("current partition %s, want %s", s.current, current)
+	}
+	if want := old[len(old)-maxOpenPartitions:]; !reflect.DeepEqual(s.used, want) {
+		t.Errorf("open partitions %v, want %v", s.used, want)
+	}
+	open := func(key string) bool {
+		s.stores[key].mu.Lock()
+		defer s.stores[key].mu.Unlock()
+		return s.stores[key].db != nil
+	}
+	if !open(current) {
+		t.Error("current partition closed")
+	}
+	for x, key := range old {
+		if evicted := x < len(old)-maxOpenPartitions; open(key) == evicted {
+			t.Errorf("partition %s open %v, want %v", key, open(key), !evicted)
+		}
+	}
+}
+
+func TestPartitionedPruneRemovesFiles(t *testing.T) {
+	now := time.Now()
+	s, dir, cleanup := partitionTestStore(t, now, now.AddDate(0, 0, -3), now.AddDate(0, 0, -10))
+	defer cleanup()
+
+	retention := 5 * 24 * time.Hour
+	policy := RetentionPolicy{Lookups: retention, Hourly: retention, Daily: retention, PDNS: retention, ClientNames: retention}
+	result, err := s.Prune(context.Background(), policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Partitions != 1 {
+		t.Errorf("removed %d partitions, want 1", result.Partitions)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "nsr-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("every partition removed")
+	}
+	for _, path := range paths {
+		if filepath.Base(path) == "nsr-"+s.p.key(s.p.start(now.AddDate(0, 0, -10)))+".db" {
+			t.Errorf("%s not removed", path)
+		}
+	}
+}
+
+func TestPartitionedPruneSkipsPruned(t *testing.T) {
+	now := time.Now()
+	old := now.AddDate(0, 0, -10)
+	s, _, cleanup := partitionTestStore(t, now, old)
+	defer cleanup()
+	key := s.p.key(s.p.start(old))
+
+	// Daily rollups are kept forever, so the old partition stays.
+	ctx := context.Background()
+	policy := RetentionPolicy{Lookups: 5 * 24 * time.Hour, Hourly: 5 * 24 * time.Hour}
+	prune := func() PruneResult {
+		t.Helper()
+		result, err := s.Prune(ctx, policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if result := prune(); result.Lookups != 1 || result.Hourly != 1 || result.Partitions != 0 {
+		t.Errorf("first prune %+v, want the old lookup and hourly rollup", result)
+	}
+	if !s.wasPruned(key) {
+		t.Fatalf("partition %s not marked pruned", key)
+	}
+	if result := prune(); result != (PruneResult{}) {
+		t.Errorf("second prune %+v, want the old partition skipped", result)
+	}
+
+	// A late lookup has the partition pruned again.
+	late := Batch{Lookups: []Lookup{{When: old.Add(time.Minute), Client: "10.0.0.1", Host: "late.example.com", Type: "A"}}}
+	if err := s.Accept(ctx, late); err != nil {
+		t.Fatal(err)
+	}
+	if s.wasPruned(key) {
+		t.Errorf("partition %s still marked pruned after a late lookup", key)
+	}
+	if result := prune(); result.Lookups != 1 {
+		t.Errorf("prune after a late lookup %+v, want the late lookup", result)
+	}
+}
@@ -0,0 +1,589 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const postgresMaxConns = 4
+
+// postgresMigrations are applied in order, like the sqlite migrations; the
+// applied versions are recorded in schema_migrations.  lookups and answers
+// are partitioned by month of ts, which requires PostgreSQL 11 or later.
+var postgresMigrations = []migration{
+	{
+		description: "create tables",
+		statements: []string{
+			"CREATE TABLE hosts (id BIGSERIAL PRIMARY KEY, name TEXT NOT NULL UNIQUE)",
+			"CREATE TABLE clients (id BIGSERIAL PRIMARY KEY, ip TEXT NOT NULL UNIQUE, name TEXT NOT NULL)",
+			"CREATE TABLE lookups (id BIGSERIAL, ts BIGINT NOT NULL, client_id BIGINT NOT NULL, host_id BIGINT NOT NULL, qtype TEXT NOT NULL DEFAULT '', UNIQUE (ts, client_id, host_id)) PARTITION BY RANGE (ts)",
+			"CREATE INDEX lookups_host_ts ON lookups (host_id, ts)",
+			"CREATE INDEX lookups_client_ts ON lookups (client_id, ts)",
+			"CREATE TABLE answers (lookup_id BIGINT NOT NULL, ts BIGINT NOT NULL, ip TEXT NOT NULL, PRIMARY KEY (lookup_id, ts, ip)) PARTITION BY RANGE (ts)",
+			"CREATE INDEX answers_ip ON answers (ip)",
+			"CREATE TABLE reverse (ip TEXT NOT NULL, name TEXT NOT NULL, PRIMARY KEY (ip, name))",
+			"CREATE TABLE pdns (rrname TEXT NOT NULL, rrtype TEXT NOT NULL, rdata TEXT NOT NULL, time_first BIGINT NOT NULL, time_last BIGINT NOT NULL, count BIGINT NOT NULL, PRIMARY KEY (rrname, rrtype, rdata))",
+			"CREATE INDEX pdns_rdata ON pdns (rdata)",
+			"CREATE TABLE client_names (ip TEXT NOT NULL, name TEXT NOT NULL, first_seen BIGINT NOT NULL, last_seen BIGINT NOT NULL, PRIMARY KEY (ip, first_seen))",
+			"CREATE TABLE rollup_hourly (bucket BIGINT NOT NULL, client_id BIGINT NOT NULL, host_id BIGINT NOT NULL, qtype TEXT NOT NULL, count BIGINT NOT NULL, PRIMARY KEY (bucket, client_id, host_id, qtype))",
+			"CREATE TABLE rollup_daily (bucket BIGINT NOT NULL, client_id BIGINT NOT NULL, host_id BIGINT NOT NULL, qtype TEXT NOT NULL, count BIGINT NOT NULL, PRIMARY KEY (bucket, client_id, host_id, qtype))",
+		},
+	},
+}
+
+// NewPostgresStore returns a Store writing to the PostgreSQL database at dsn
+// with the data model of the sqlite store.  Batches are written with one
+// multi-row statement per table, so several nsr instances on the same NSQ
+// channel can share the database.
+func NewPostgresStore(dsn string) Store {
+	return &postgresStore{dsn: dsn, partitions: map[string]bool{}}
+}
+
+type postgresStore struct {
+	dsn string
+
+	mu         sync.Mutex
+	db         *sql.DB
+	partitions map[string]bool
+}
+
+func (s *postgresStore) Accept(ctx context.Context, batch Batch) error {
+	db, err := s.open()
+	if err != nil {
+		return errors.Wrap(err, "opening connection to postgres db")
+	}
+	if err = s.ensurePartitions(ctx, db, batch.Lookups); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	if err = postgresAccept(tx, batch.Clients, batch.Lookups); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "committing transaction")
+}
+
+func (s *postgresStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return errors.Wrap(err, "closing postgres db")
+}
+
+// Healthy opens and migrates the db, unless that has been done already, and
+// checks the connection.
+func (s *postgresStore) Healthy(ctx context.Context) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(db.PingContext(ctx), "pinging postgres db")
+}
+
+func (s *postgresStore) open() (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db != nil {
+		return s.db, nil
+	}
+	db, err := sql.Open("postgres", s.dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening postgres db connection")
+	}
+	db.SetMaxOpenConns(postgresMaxConns)
+	if err = postgresMigrate(db); err != nil {
+		_ = db.Close()
+		logger.Error("migrating schema", "store", "postgres", "error", err)
+		return nil, errors.Wrapf(ErrInitializationFailed, "migrating schema: %v", err)
+	}
+	s.db = db
+	return db, nil
+}
+
+func postgresMigrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Only one instance migrates at a time; the others wait, then find
+	// nothing left to do.
+	for _, statement := range []string{
+		"SELECT pg_advisory_xact_lock(hashtext('nsr schema_migrations'))",
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, description TEXT NOT NULL)",
+	} {
+		if _, err = tx.Exec(statement); err != nil {
+			return errors.Wrapf(err, "executing %q", statement)
+		}
+	}
+	var version int
+	if err = tx.QueryRow("SELECT coalesce(max(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return errors.Wrap(err, "reading schema version")
+	}
+	if version > len(postgresMigrations) {
+		return errors.Wrapf(ErrSchemaTooNew, "version %d, latest known %d", version, len(postgresMigrations))
+	}
+	for x, m := range postgresMigrations[version:] {
+		v := version + x + 1
+		for _, statement := range m.statements {
+			if _, err = tx.Exec(statement); err != nil {
+				return errors.Wrapf(err, "migrating to version %d: executing %q", v, statement)
+			}
+		}
+		if m.apply != nil {
+			if err = m.apply(tx); err != nil {
+				return errors.Wrapf(err, "migrating to version %d", v)
+			}
+		}
+		if _, err = tx.Exec("INSERT INTO schema_migrations (version, description) VALUES ($1, $2)", v, m.description); err != nil {
+			return errors.Wrap(err, "recording schema version")
+		}
+		logger.Info("migrated schema", "store", "postgres", "version", v, "migration", m.description)
+	}
+	return errors.Wrap(tx.Commit(), "committing migrations")
+}
+
+// month returns the bounds, in nanoseconds since the unix epoch, and the
+// partition suffix of the UTC month holding ts.
+func month(ts int64) (int64, int64, string) {
+	t := time.Unix(0, ts).UTC()
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.UnixNano(), start.AddDate(0, 1, 0).UnixNano(), start.Format("p2006_01")
+}
+
+// ensurePartitions creates the monthly partitions lookups will be written to.
+// It runs outside the batch transaction so that a partition created
+// concurrently by another instance does not abort the batch.
+func (s *postgresStore) ensurePartitions(ctx context.Context, db *sql.DB, lookups []Lookup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, lookup := range lookups {
+		from, to, suffix := month(lookup.When.UnixNano())
+		if s.partitions[suffix] {
+			continue
+		}
+		for _, table := range []string{"lookups", "answers"} {
+			statement := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_%s PARTITION OF %s FOR VALUES FROM (%d) TO (%d)", table, suffix, table, from, to)
+			if _, err := db.ExecContext(ctx, statement); err != nil && !isDuplicate(err) {
+				return errors.Wrapf(err, "creating partition %s_%s", table, suffix)
+			}
+		}
+		s.partitions[suffix] = true
+	}
+	return nil
+}
+
+func isDuplicate(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && (pqErr.Code == "42P07" || pqErr.Code == "23505")
+}
+
+type lookupKey struct {
+	ts               int64
+	clientID, hostID int64
+}
+
+type rollupKey struct {
+	bucket           int64
+	clientID, hostID int64
+	qtype            string
+}
+
+type pdnsEntry struct {
+	first, last, count int64
+}
+
+func postgresAccept(tx *sql.Tx, clients []Client, lookups []Lookup) error {
+	names := map[string]string{}
+	for _, client := range clients {
+		names[client.IP] = client.Name
+	}
+	var hostNames, ips []string
+	for _, lookup := range lookups {
+		hostNames = append(hostNames, lookup.Host)
+		ips = append(ips, lookup.Client)
+	}
+
+	hostIDs, err := postgresHosts(tx, hostNames)
+	if err != nil {
+		return err
+	}
+	clientIDs, err := postgresClients(tx, names, ips)
+	if err != nil {
+		return err
+	}
+
+	var (
+		tss, clientCol, hostCol []int64
+		qtypes                  []string
+	)
+	for _, lookup := range lookups {
+		tss = append(tss, lookup.When.UnixNano())
+		clientCol = append(clientCol, clientIDs[lookup.Client])
+		hostCol = append(hostCol, hostIDs[lookup.Host])
+		qtypes = append(qtypes, lookup.Type)
+	}
+	rows, err := tx.Query("INSERT INTO lookups (ts, client_id, host_id, qtype) "+
+		"SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::bigint[], $4::text[]) "+
+		"ON CONFLICT (ts, client_id, host_id) DO NOTHING RETURNING id, ts, client_id, host_id",
+		pq.Array(tss), pq.Array(clientCol), pq.Array(hostCol), pq.Array(qtypes))
+	if err != nil {
+		return errors.Wrap(err, "inserting lookups")
+	}
+	inserted := map[lookupKey]int64{}
+	for rows.Next() {
+		var (
+			id  int64
+			key lookupKey
+		)
+		if err = rows.Scan(&id, &key.ts, &key.clientID, &key.hostID); err != nil {
+			_ = rows.Close()
+			return errors.Wrap(err, "scanning inserted lookup")
+		}
+		inserted[key] = id
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "reading inserted lookups")
+	}
+
+	// Everything below is only recorded for lookups seen for the first time,
+	// as when NSQ redelivers a message.
+	var (
+		answerIDs, answerTS []int64
+		answerIPs           []string
+		revIPs, revNames    []string
+		pdns                = map[Record]*pdnsEntry{}
+		hourly              = map[rollupKey]int64{}
+		daily               = map[rollupKey]int64{}
+		fresh               []Lookup
+	)
+	for x, lookup := range lookups {
+		key := lookupKey{ts: tss[x], clientID: clientCol[x], hostID: hostCol[x]}
+		id, ok := inserted[key]
+		if !ok {
+			continue
+		}
+		delete(inserted, key)
+		fresh = append(fresh, lookup)
+
+		for _, ip := range lookup.AllIPs {
+			answerIDs, answerTS, answerIPs = append(answerIDs, id), append(answerTS, key.ts), append(answerIPs, ip)
+			revIPs, revNames = append(revIPs, ip), append(revNames, lookup.Host)
+		}
+		for _, record := range lookup.records() {
+			if entry, ok := pdns[record]; ok {
+				entry.count++
+				if key.ts < entry.first {
+					entry.first = key.ts
+				}
+				if key.ts > entry.last {
+					entry.last = key.ts
+				}
+				continue
+			}
+			pdns[record] = &pdnsEntry{first: key.ts, last: key.ts, count: 1}
+		}
+		hourly[rollupKey{bucket(key.ts, hour), key.clientID, key.hostID, lookup.Type}]++
+		daily[rollupKey{bucket(key.ts, day), key.clientID, key.hostID, lookup.Type}]++
+	}
+
+	if len(answerIDs) > 0 {
+		if _, err = tx.Exec("INSERT INTO answers (lookup_id, ts, ip) SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::text[]) ON CONFLICT DO NOTHING",
+			pq.Array(answerIDs), pq.Array(answerTS), pq.Array(answerIPs)); err != nil {
+			return errors.Wrap(err, "inserting answers")
+		}
+		if _, err = tx.Exec("INSERT INTO reverse (ip, name) SELECT DISTINCT * FROM unnest($1::text[], $2::text[]) ON CONFLICT DO NOTHING",
+			pq.Array(revIPs), pq.Array(revNames)); err != nil {
+			return errors.Wrap(err, "inserting reverse")
+		}
+	}
+	if err = postgresPDNS(tx, pdns); err != nil {
+		return err
+	}
+	for table, counts := range map[string]map[rollupKey]int64{"rollup_hourly": hourly, "rollup_daily": daily} {
+		if err = postgresRollup(tx, table, counts); err != nil {
+			return err
+		}
+	}
+	return postgresClientNames(tx, names, fresh)
+}
+
+// postgresHosts interns names and returns their ids.
+func postgresHosts(tx *sql.Tx, names []string) (map[string]int64, error) {
+	names = uniqueSorted(names)
+	if _, err := tx.Exec("INSERT INTO hosts (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING", pq.Array(names)); err != nil {
+		return nil, errors.Wrap(err, "inserting hosts")
+	}
+	return postgresIDs(tx, "SELECT id, name FROM hosts WHERE name = ANY($1)", names)
+}
+
+// postgresClients renames the clients in names, interns ips and returns the
+// ids of both.
+func postgresClients(tx *sql.Tx, names map[string]string, ips []string) (map[string]int64, error) {
+	var named, renamed []string
+	for ip := range names {
+		named = append(named, ip)
+	}
+	sort.Strings(named)
+	for _, ip := range named {
+		renamed = append(renamed, names[ip])
+	}
+	if _, err := tx.Exec("INSERT INTO clients (ip, name) SELECT * FROM unnest($1::text[], $2::text[]) ON CONFLICT (ip) DO UPDATE SET name = excluded.name",
+		pq.Array(named), pq.Array(renamed)); err != nil {
+		return nil, errors.Wrap(err, "upserting clients")
+	}
+	ips = uniqueSorted(append(ips, named...))
+	if _, err := tx.Exec("INSERT INTO clients (ip, name) SELECT ip, ip FROM unnest($1::text[]) AS ip ON CONFLICT (ip) DO NOTHING", pq.Array(ips)); err != nil {
+		return nil, errors.Wrap(err, "inserting clients")
+	}
+	return postgresIDs(tx, "SELECT id, ip FROM clients WHERE ip = ANY($1)", ips)
+}
+
+func postgresIDs(tx *sql.Tx, query string, keys []string) (map[string]int64, error) {
+	rows, err := tx.Query(query, pq.Array(keys))
+	if err != nil {
+		return nil, errors.Wrap(err, "selecting ids")
+	}
+	defer rows.Close()
+	ids := map[string]int64{}
+	for rows.Next() {
+		var (
+			id  int64
+			key string
+		)
+		if err = rows.Scan(&id, &key); err != nil {
+			return nil, errors.Wrap(err, "scanning id")
+		}
+		ids[key] = id
+	}
+	return ids, errors.Wrap(rows.Err(), "reading ids")
+}
+
+func postgresPDNS(tx *sql.Tx, pdns map[Record]*pdnsEntry) error {
+	if len(pdns) == 0 {
+		return nil
+	}
+	records := make([]Record, 0, len(pdns))
+	for record := range pdns {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		return a.Name < b.Name || a.Name == b.Name && (a.Type < b.Type || a.Type == b.Type && a.Data < b.Data)
+	})
+	var (
+		rrnames, rrtypes, rdatas []string
+		firsts, lasts, counts    []int64
+	)
+	for _, record := range records {
+		entry := pdns[record]
+		rrnames, rrtypes, rdatas = append(rrnames, record.Name), append(rrtypes, record.Type), append(rdatas, record.Data)
+		firsts, lasts, counts = append(firsts, entry.first), append(lasts, entry.last), append(counts, entry.count)
+	}
+	_, err := tx.Exec("INSERT INTO pdns (rrname, rrtype, rdata, time_first, time_last, count) "+
+		"SELECT * FROM unnest($1::text[], $2::text[], $3::text[], $4::bigint[], $5::bigint[], $6::bigint[]) "+
+		"ON CONFLICT (rrname, rrtype, rdata) DO UPDATE SET time_first = least(pdns.time_first, excluded.time_first), "+
+		"time_last = greatest(pdns.time_last, excluded.time_last), count = pdns.count + excluded.count",
+		pq.Array(rrnames), pq.Array(rrtypes), pq.Array(rdatas), pq.Array(firsts), pq.Array(lasts), pq.Array(counts))
+	return errors.Wrap(err, "upserting pdns")
+}
+
+func postgresRollup(tx *sql.Tx, table string, counts map[rollupKey]int64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	keys := make([]rollupKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.bucket != b.bucket {
+			return a.bucket < b.bucket
+		}
+		if a.clientID != b.clientID {
+			return a.clientID < b.clientID
+		}
+		if a.hostID != b.hostID {
+			return a.hostID < b.hostID
+		}
+		return a.qtype < b.qtype
+	})
+	var (
+		buckets, clientIDs, hostIDs, ns []int64
+		qtypes                          []string
+	)
+	for _, key := range keys {
+		buckets, clientIDs, hostIDs = append(buckets, key.bucket), append(clientIDs, key.clientID), append(hostIDs, key.hostID)
+		qtypes, ns = append(qtypes, key.qtype), append(ns, counts[key])
+	}
+	_, err := tx.Exec("INSERT INTO "+table+" (bucket, client_id, host_id, qtype, count) "+
+		"SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::bigint[], $4::text[], $5::bigint[]) "+
+		"ON CONFLICT (bucket, client_id, host_id, qtype) DO UPDATE SET count = "+table+".count + excluded.count",
+		pq.Array(buckets), pq.Array(clientIDs), pq.Array(hostIDs), pq.Array(qtypes), pq.Array(ns))
+	return errors.Wrapf(err, "upserting %s", table)
+}
+
+// postgresClientNames is the postgres version of sqliteTx.clientNames.
+func postgresClientNames(tx *sql.Tx, names map[string]string, lookups []Lookup) error {
+	first, last := map[string]int64{}, map[string]int64{}
+	for _, lookup := range lookups {
+		ts := lookup.When.UnixNano()
+		if f, ok := first[lookup.Client]; !ok || ts < f {
+			first[lookup.Client] = ts
+		}
+		if l, ok := last[lookup.Client]; !ok || ts > l {
+			last[lookup.Client] = ts
+		}
+	}
+	for ip, name := range names {
+		if _, ok := first[ip]; !ok {
+			continue
+		}
+		var (
+			current   string
+			firstSeen int64
+		)
+		err := tx.QueryRow("SELECT name, first_seen FROM client_names WHERE ip = $1 ORDER BY first_seen DESC LIMIT 1", ip).Scan(&current, &firstSeen)
+		switch {
+		case err == nil && current == name:
+			_, err = tx.Exec("UPDATE client_names SET last_seen = greatest(last_seen, $1) WHERE ip = $2 AND first_seen = $3", last[ip], ip, firstSeen)
+		case err == nil || err == sql.ErrNoRows:
+			_, err = tx.Exec("INSERT INTO client_names (ip, name, first_seen, last_seen) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING", ip, name, first[ip], last[ip])
+		}
+		if err != nil {
+			return errors.Wrap(err, "recording client name")
+		}
+	}
+	return nil
+}
+
+// Prune drops the monthly partitions entirely older than the lookup
+// retention, then deletes the remaining expired rows.
+func (s *postgresStore) Prune(ctx context.Context, policy RetentionPolicy, now time.Time) (PruneResult, error) {
+	var result PruneResult
+	db, err := s.open()
+	if err != nil {
+		return result, errors.Wrap(err, "opening connection to postgres db")
+	}
+
+	if policy.Lookups > 0 {
+		cutoff := now.Add(-policy.Lookups).UnixNano()
+		if result.Lookups, err = s.dropPartitions(ctx, db, cutoff); err != nil {
+			return result, err
+		}
+		if _, err = db.ExecContext(ctx, "DELETE FROM answers WHERE ts < $1", cutoff); err != nil {
+			return result, errors.Wrap(err, "pruning answers")
+		}
+		n, err := execCount(db.ExecContext(ctx, "DELETE FROM lookups WHERE ts < $1", cutoff))
+		result.Lookups += n
+		if err != nil {
+			return result, errors.Wrap(err, "pruning lookups")
+		}
+	}
+	if policy.Hourly > 0 {
+		if result.Hourly, err = execCount(db.ExecContext(ctx, "DELETE FROM rollup_hourly WHERE bucket < $1", now.Add(-policy.Hourly).UnixNano())); err != nil {
+			return result, errors.Wrap(err, "pruning rollup_hourly")
+		}
+	}
+	if policy.Daily > 0 {
+		if result.Daily, err = execCount(db.ExecContext(ctx, "DELETE FROM rollup_daily WHERE bucket < $1", now.Add(-policy.Daily).UnixNano())); err != nil {
+			return result, errors.Wrap(err, "pruning rollup_daily")
+		}
+	}
+	if policy.PDNS > 0 {
+		if result.Related, err = execCount(db.ExecContext(ctx, "DELETE FROM pdns WHERE time_last < $1", now.Add(-policy.PDNS).UnixNano())); err != nil {
+			return result, errors.Wrap(err, "pruning pdns")
+		}
+	}
+	if policy.ClientNames > 0 {
+		n, err := execCount(db.ExecContext(ctx, "DELETE FROM client_names WHERE last_seen < $1", now.Add(-policy.ClientNames).UnixNano()))
+		result.Related += n
+		if err != nil {
+			return result, errors.Wrap(err, "pruning client_names")
+		}
+	}
+	return result, nil
+}
+
+func (s *postgresStore) dropPartitions(ctx context.Context, db *sql.DB, cutoff int64) (int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'lookups'::regclass")
+	if err != nil {
+		return 0, errors.Wrap(err, "listing partitions")
+	}
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return 0, errors.Wrap(err, "scanning partition")
+		}
+		start, err := time.Parse("p2006_01", strings.TrimPrefix(name, "lookups_"))
+		if err != nil {
+			continue
+		}
+		if start.AddDate(0, 1, 0).UnixNano() <= cutoff {
+			expired = append(expired, strings.TrimPrefix(name, "lookups_"))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "reading partitions")
+	}
+
+	var dropped int64
+	for _, suffix := range expired {
+		var n int64
+		if err = db.QueryRowContext(ctx, "SELECT count(*) FROM lookups_"+suffix).Scan(&n); err != nil {
+			return dropped, errors.Wrapf(err, "counting lookups_%s", suffix)
+		}
+		for _, table := range []string{"answers", "lookups"} {
+			if _, err = db.ExecContext(ctx, "DROP TABLE IF EXISTS "+table+"_"+suffix); err != nil {
+				return dropped, errors.Wrapf(err, "dropping %s_%s", table, suffix)
+			}
+		}
+		s.mu.Lock()
+		delete(s.partitions, suffix)
+		s.mu.Unlock()
+		dropped += n
+		logger.Info("dropped partition", "store", "postgres", "partition", suffix, "lookups", n)
+	}
+	return dropped, nil
+}
+
+func execCount(result sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	unique := values[:0]
+	for x, value := range values {
+		if x == 0 || value != values[x-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,211 @@
+package nsrecorder
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postgresTestDSN returns a connection string for a fresh schema of the
+// database at POSTGRES_DSN, and a func dropping it.  The test is skipped
+// without POSTGRES_DSN.
+func postgresTestDSN(t *testing.T) (string, func()) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("nsr_test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		_ = admin.Close()
+		t.Fatal(err)
+	}
+	drop := func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+		_ = admin.Close()
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			drop()
+			t.Fatal(err)
+		}
+		params := u.Query()
+		params.Set("search_path", schema)
+		u.RawQuery = params.Encode()
+		return u.String(), drop
+	}
+	return dsn + " search_path=" + schema, drop
+}
+
+func postgresCount(t *testing.T, db *sql.DB, query string, args ...interface{}) int64 {
+	t.Helper()
+	var n int64
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func TestPostgresMigrateConcurrently(t *testing.T) {
+	dsn, drop := postgresTestDSN(t)
+	defer drop()
+
+	// Without the advisory lock, the instances would race to create the
+	// same tables.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for x := 0; x < cap(errs); x++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := sql.Open("postgres", dsn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+			errs <- postgresMigrate(db)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := postgresCount(t, db, "SELECT count(*) FROM schema_migrations"); n != int64(len(postgresMigrations)) {
+		t.Errorf("recorded %d migrations, want %d", n, len(postgresMigrations))
+	}
+	if err = postgresMigrate(db); err != nil {
+		t.Errorf("migrating a migrated db: %v", err)
+	}
+}
+
+func TestPostgresPartitions(t *testing.T) {
+	dsn, drop := postgresTestDSN(t)
+	defer drop()
+	store := NewPostgresStore(dsn)
+	defer store.Close()
+
+	ctx := context.Background()
+	old := time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)
+	recent := time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+	batch := Batch{Lookups: []Lookup{
+		{When: old, Client: "10.0.0.1", Host: "old.example.com", Type: "A", AllIPs: []string{"192.0.2.1"}},
+		{When: recent, Client: "10.0.0.1", Host: "recent.example.com", Type: "A", AllIPs: []string{"192.0.2.2"}},
+	}}
+	if err := store.Accept(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exists := func(table string) bool {
+		return postgresCount(t, db, "SELECT count(*) FROM pg_class WHERE oid = to_regclass($1)", table) == 1
+	}
+	for _, table := range []string{"lookups_p2026_01", "answers_p2026_01", "lookups_p2026_03", "answers_p2026_03"} {
+		if !exists(table) {
+			t.Errorf("missing partition %s", table)
+		}
+	}
+
+	// January ends before the cutoff, March does not.
+	result, err := store.(Pruner).Prune(ctx, RetentionPolicy{Lookups: 24 * time.Hour}, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Lookups != 1 {
+		t.Errorf("pruned %d lookups, want 1", result.Lookups)
+	}
+	for _, table := range []string{"lookups_p2026_01", "answers_p2026_01"} {
+		if exists(table) {
+			t.Errorf("partition %s not dropped", table)
+		}
+	}
+	if !exists("lookups_p2026_03") {
+		t.Error("partition lookups_p2026_03 dropped")
+	}
+
+	// A late lookup recreates the dropped partition.
+	if err = store.Accept(ctx, Batch{Lookups: batch.Lookups[:1]}); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("lookups_p2026_01") {
+		t.Error("partition lookups_p2026_01 not recreated")
+	}
+}
+
+func TestPostgresRedeliveredBatch(t *testing.T) {
+	dsn, drop := postgresTestDSN(t)
+	defer drop()
+	store := NewPostgresStore(dsn)
+	defer store.Close()
+
+	when := time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+	lookup := Lookup{When: when, Client: "10.0.0.1", Host: "example.com", Type: "A", AllIPs: []string{"192.0.2.1", "192.0.2.2"}}
+	// The batch repeats a lookup, and is delivered twice.
+	batch := Batch{
+		Clients: []Client{{IP: "10.0.0.1", Name: "laptop"}},
+		Lookups: []Lookup{lookup, lookup, {When: when.Add(time.Second), Client: "10.0.0.2", Host: "example.com", Type: "AAAA"}},
+	}
+	ctx := context.Background()
+	for x := 0; x < 2; x++ {
+		if err := store.Accept(ctx, batch); err != nil {
+			t.Fatalf("delivery %d: %v", x+1, err)
+		}
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tc := range []struct {
+		query string
+		want  int64
+	}{
+		{"SELECT count(*) FROM hosts", 1},
+		{"SELECT count(*) FROM clients", 2},
+		{"SELECT count(*) FROM lookups", 2},
+		{"SELECT count(*) FROM answers", 2},
+		{"SELECT count(*) FROM reverse", 2},
+		{"SELECT coalesce(sum(count), 0) FROM pdns", 2},
+		{"SELECT coalesce(sum(count), 0) FROM rollup_hourly", 2},
+		{"SELECT coalesce(sum(count), 0) FROM rollup_daily", 2},
+		{"SELECT count(*) FROM client_names", 1},
+	} {
+		if got := postgresCount(t, db, tc.query); got != tc.want {
+			t.Errorf("%s = %d, want %d", tc.query, got, tc.want)
+		}
+	}
+	var name string
+	if err = db.QueryRow("SELECT name FROM clients WHERE ip = '10.0.0.1'").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "laptop" {
+		t.Errorf("client named %q, want laptop", name)
+	}
+}
@@ -0,0 +1,305 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownPseudonymMode = errors.New("unknown pseudonymization mode")
+
+// Pseudonymizer returns the pseudonyms replacing a client ip and the name it
+// resolved to.  Unresolved clients are named by their ip.
+type Pseudonymizer func(ip, name string) (string, string)
+
+// NewPseudonymizer returns the Pseudonymizer for mode: "hmac", keyed by key,
+// or "truncate".
+func NewPseudonymizer(mode string, key []byte) (Pseudonymizer, error) {
+	switch mode {
+	case "hmac":
+		if len(key) == 0 {
+			return nil, errors.New("missing pseudonym key")
+		}
+		return HMACPseudonyms(key), nil
+	case "truncate":
+		return TruncatedIPs, nil
+	}
+	return nil, errors.Wrapf(ErrUnknownPseudonymMode, "%q", mode)
+}
+
+// HMACPseudonyms returns a Pseudonymizer replacing ips and names by the
+// first 16 hex digits of their HMAC-SHA256 under key, prefixed by "ip-" and
+// "name-".  A client keeps the same pseudonyms as long as the key does not
+// change, and they can not be reversed without it.
+func HMACPseudonyms(key []byte) Pseudonymizer {
+	sum := func(prefix, s string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(s))
+		return prefix + hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	return func(ip, name string) (string, string) {
+		pseudonym := sum("ip-", ip)
+		if name == ip {
+			return pseudonym, pseudonym
+		}
+		return pseudonym, sum("name-", name)
+	}
+}
+
+// TruncatedIPs is a Pseudonymizer keeping the first 24 bits of IPv4 and 48
+// bits of IPv6 client ips, and naming clients by their truncated ip, as
+// names may identify them.  An invalid ip is replaced by "invalid-" and the
+// first 16 hex digits of its SHA-256, so that invalid clients stay apart.
+func TruncatedIPs(ip, _ string) (string, string) {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		sum := sha256.Sum256([]byte(ip))
+		pseudonym := "invalid-" + hex.EncodeToString(sum[:])[:16]
+		return pseudonym, pseudonym
+	case parsed.To4() != nil:
+		parsed = parsed.Mask(net.CIDRMask(24, 32))
+	default:
+		parsed = parsed.Mask(net.CIDRMask(48, 128))
+	}
+	return parsed.String(), parsed.String()
+}
+
+// PrivateNetworks are where LAN clients live: the IPv4 private, shared,
+// loopback and link-local ranges, and the IPv6 unique local, loopback and
+// link-local ones.
+var PrivateNetworks = parseNetworks("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "fc00::/7", "fe80::/10", "::1/128")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Pseudonymize wraps store so that the client ips and names of every batch
+// are replaced using p before store accepts it.  The addresses of clients,
+// those of the batch and any inside networks, are replaced in answers too,
+// and so are the names they resolve from or to: the host of a lookup
+// answered with one, the reverse name of a PTR lookup of one and the names
+// it points to.  The same address or name gets the same pseudonym in the
+// clients, lookups, answers and reverse table.  Batches are copied, so the
+// caller's batch is left as it was.
+func Pseudonymize(store Store, p Pseudonymizer, networks []*net.IPNet) Store {
+	return &pseudonymStore{store: store, p: p, networks: networks}
+}
+
+type pseudonymStore struct {
+	store    Store
+	p        Pseudonymizer
+	networks []*net.IPNet
+}
+
+func (s *pseudonymStore) Accept(ctx context.Context, batch Batch) error {
+	ips := make(map[string]string, len(batch.Clients))
+	copied := Batch{Clients: make([]Client, len(batch.Clients)), Lookups: make([]Lookup, len(batch.Lookups))}
+	for x, client := range batch.Clients {
+		ip, name := s.p(client.IP, client.Name)
+		ips[client.IP] = ip
+		copied.Clients[x] = Client{IP: ip, Name: name}
+	}
+	for _, lookup := range batch.Lookups {
+		s.ip(lookup.Client, ips)
+	}
+	for x, lookup := range batch.Lookups {
+		copied.Lookups[x] = s.lookup(lookup, ips)
+	}
+	return s.store.Accept(ctx, copied)
+}
+
+// ip returns the pseudonym of a client ip, recording it in ips.
+func (s *pseudonymStore) ip(ip string, ips map[string]string) string {
+	pseudonym, ok := ips[ip]
+	if !ok {
+		pseudonym, _ = s.p(ip, ip)
+		ips[ip] = pseudonym
+	}
+	return pseudonym
+}
+
+// local says whether ip, found in an answer, is that of a client: one of
+// the batch, or one inside the client networks.
+func (s *pseudonymStore) local(ip string, ips map[string]string) bool {
+	if _, ok := ips[ip]; ok {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range s.networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns a copy of lookup with its client, and the addresses and
+// names of clients in it, replaced.
+func (s *pseudonymStore) lookup(lookup Lookup, ips map[string]string) Lookup {
+	lookup.Client = s.ip(lookup.Client, ips)
+
+	// names maps the names of clients to their pseudonyms.
+	names := map[string]string{}
+	rename := func(name, ip string) {
+		if _, ok := names[name]; ok {
+			return
+		}
+		if ptr, ok := arpaIP(name); ok && ptr == ip {
+			names[name] = arpaName(s.ip(ip, ips), ip)
+			return
+		}
+		_, names[name] = s.p(ip, name)
+	}
+	if ip, ok := arpaIP(lookup.Host); ok && s.local(ip, ips) {
+		rename(lookup.Host, ip)
+	}
+	for _, ip := range lookup.AllIPs {
+		if s.local(ip, ips) {
+			rename(lookup.Host, ip)
+			break
+		}
+	}
+	for _, record := range lookup.Answers {
+		switch record.Type {
+		case "A", "AAAA":
+			if s.local(record.Data, ips) {
+				rename(record.Name, record.Data)
+			}
+		case "PTR":
+			if ip, ok := arpaIP(record.Name); ok && s.local(ip, ips) {
+				rename(record.Name, ip)
+				rename(record.Data, ip)
+			}
+		}
+	}
+
+	address := func(ip string) string {
+		if s.local(ip, ips) {
+			return s.ip(ip, ips)
+		}
+		return ip
+	}
+	name := func(name string) string {
+		if pseudonym, ok := names[name]; ok {
+			return pseudonym
+		}
+		return name
+	}
+	lookup.Host = name(lookup.Host)
+	if lookup.FirstIP != "" {
+		lookup.FirstIP = address(lookup.FirstIP)
+	}
+	if lookup.AllIPs != nil {
+		all := make([]string, len(lookup.AllIPs))
+		for x, ip := range lookup.AllIPs {
+			all[x] = address(ip)
+		}
+		lookup.AllIPs = all
+	}
+	if lookup.Answers != nil {
+		answers := make([]Record, len(lookup.Answers))
+		for x, record := range lookup.Answers {
+			record.Name = name(record.Name)
+			if record.Type == "A" || record.Type == "AAAA" {
+				record.Data = address(record.Data)
+			} else {
+				record.Data = name(record.Data)
+			}
+			answers[x] = record
+		}
+		lookup.Answers = answers
+	}
+	return lookup
+}
+
+// arpaIP returns the ip named by a reverse lookup name, such as
+// 1.0.0.10.in-addr.arpa for 10.0.0.1.
+func arpaIP(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var ip net.IP
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return "", false
+		}
+		for x, y := 0, len(labels)-1; x < y; x, y = x+1, y-1 {
+			labels[x], labels[y] = labels[y], labels[x]
+		}
+		ip = net.ParseIP(strings.Join(labels, "."))
+		if ip == nil || ip.To4() == nil {
+			return "", false
+		}
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return "", false
+		}
+		var hexIP []byte
+		for x := len(nibbles) - 1; x >= 0; x-- {
+			if len(nibbles[x]) != 1 {
+				return "", false
+			}
+			hexIP = append(hexIP, nibbles[x][0])
+		}
+		raw, err := hex.DecodeString(string(hexIP))
+		if err != nil {
+			return "", false
+		}
+		ip = net.IP(raw)
+	default:
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// arpaName returns the reverse lookup name of pseudonym, the pseudonym of
+// ip: its in-addr.arpa or ip6.arpa name if it is an ip, as truncated ips
+// are, or the pseudonym under the zone of ip otherwise.
+func arpaName(pseudonym, ip string) string {
+	zone := ".in-addr.arpa"
+	if strings.Contains(ip, ":") {
+		zone = ".ip6.arpa"
+	}
+	parsed := net.ParseIP(pseudonym)
+	switch {
+	case parsed == nil:
+		return pseudonym + zone
+	case parsed.To4() != nil:
+		v4 := parsed.To4()
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+	nibbles := make([]string, 0, 32)
+	digits := hex.EncodeToString(parsed.To16())
+	for x := len(digits) - 1; x >= 0; x-- {
+		nibbles = append(nibbles, digits[x:x+1])
+	}
+	return strings.Join(nibbles, ".") + ".ip6.arpa"
+}
+
+func (s *pseudonymStore) Close() error { return s.store.Close() }
+
+func (s *pseudonymStore) Healthy(ctx context.Context) error {
+	if checker, ok := s.store.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package nsrecorder
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// batchStore keeps the last batch it accepted.
+type batchStore struct{ batch Batch }
+
+func (s *batchStore) Accept(_ context.Context, batch Batch) error {
+	s.batch = batch
+	return nil
+}
+
+func (s *batchStore) Close() error { return nil }
+
+func TestHMACPseudonyms(t *testing.T) {
+	p := HMACPseudonyms([]byte("key"))
+	ip, name := p("10.0.0.1", "laptop")
+	if !strings.HasPrefix(ip, "ip-") || len(ip) != 19 || !strings.HasPrefix(name, "name-") || len(name) != 21 {
+		t.Errorf("pseudonyms %q and %q", ip, name)
+	}
+	if again, _ := p("10.0.0.1", "phone"); again != ip {
+		t.Errorf("ip pseudonym changed from %q to %q", ip, again)
+	}
+	if other, _ := p("10.0.0.2", "laptop"); other == ip {
+		t.Error("two ips with the same pseudonym")
+	}
+	if rekeyed, _ := HMACPseudonyms([]byte("other"))("10.0.0.1", "laptop"); rekeyed == ip {
+		t.Error("pseudonym does not depend on the key")
+	}
+	// An unresolved client is named by its ip.
+	if ip, name = p("10.0.0.1", "10.0.0.1"); name != ip {
+		t.Errorf("unresolved client named %q, want %q", name, ip)
+	}
+}
+
+func TestTruncatedIPs(t *testing.T) {
+	for _, tc := range []struct {
+		ip, want string
+	}{
+		{"192.168.1.77", "192.168.1.0"},
+		{"10.0.0.1", "10.0.0.0"},
+		{"2001:db8:1:2::5", "2001:db8:1::"},
+		{"::ffff:192.168.1.77", "192.168.1.0"},
+	} {
+		ip, name := TruncatedIPs(tc.ip, "laptop")
+		if ip != tc.want || name != tc.want {
+			t.Errorf("TruncatedIPs(%q) = %q, %q, want %q", tc.ip, ip, name, tc.want)
+		}
+	}
+
+	invalid, _ := TruncatedIPs("not-an-ip", "")
+	other, _ := TruncatedIPs("also-not-an-ip", "")
+	if !strings.HasPrefix(invalid, "invalid-") || invalid == other {
+		t.Errorf("invalid ips truncated to %q and %q, want distinct pseudonyms", invalid, other)
+	}
+	if again, _ := TruncatedIPs("not-an-ip", ""); again != invalid {
+		t.Errorf("invalid ip pseudonym changed from %q to %q", invalid, again)
+	}
+}
+
+func TestArpaNames(t *testing.T) {
+	for _, tc := range []struct {
+		name, ip string
+	}{
+		{"1.0.0.10.in-addr.arpa", "10.0.0.1"},
+		{"77.1.168.192.IN-ADDR.ARPA.", "192.168.1.77"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "2001:db8::1"},
+	} {
+		ip, ok := arpaIP(tc.name)
+		if !ok || ip != tc.ip {
+			t.Errorf("arpaIP(%q) = %q, %v, want %q", tc.name, ip, ok, tc.ip)
+		}
+		if name := arpaName(tc.ip, tc.ip); !strings.EqualFold(name, strings.TrimSuffix(tc.name, ".")) {
+			t.Errorf("arpaName(%q) = %q, want %q", tc.ip, name, tc.name)
+		}
+	}
+	for _, name := range []string{"example.com", "10.in-addr.arpa", "x.0.0.10.in-addr.arpa", "1.2.ip6.arpa"} {
+		if ip, ok := arpaIP(name); ok {
+			t.Errorf("arpaIP(%q) = %q, want no ip", name, ip)
+		}
+	}
+	if name := arpaName("ip-0123456789abcdef", "10.0.0.1"); name != "ip-0123456789abcdef.in-addr.arpa" {
+		t.Errorf("arpaName of an hmac pseudonym = %q", name)
+	}
+}
+
+func pseudonymBatch() Batch {
+	when := time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+	return Batch{
+		Clients: []Client{{IP: "10.0.0.1", Name: "laptop.lan"}},
+		Lookups: []Lookup{
+			{When: when, Client: "10.0.0.1", Host: "example.com", Type: "A", FirstIP: "192.0.2.1", AllIPs: []string{"192.0.2.1"},
+				Answers: []Record{{Name: "example.com", Type: "A", Data: "192.0.2.1"}}},
+			{When: when, Client: "10.0.0.1", Host: "1.0.0.10.in-addr.arpa", Type: "PTR",
+				Answers: []Record{{Name: "1.0.0.10.in-addr.arpa", Type: "PTR", Data: "laptop.lan"}}},
+			{When: when, Client: "10.0.0.1", Host: "www.lan", Type: "A", FirstIP: "192.168.1.20", AllIPs: []string{"192.168.1.20"},
+				Answers: []Record{{Name: "www.lan", Type: "CNAME", Data: "printer.lan"}, {Name: "printer.lan", Type: "A", Data: "192.168.1.20"}}},
+			{When: when, Client: "2001:db8::1", Host: "self.example.net", Type: "AAAA", FirstIP: "2001:db8::1", AllIPs: []string{"2001:db8::1"}},
+		},
+	}
+}
+
+func TestPseudonymizeStore(t *testing.T) {
+	batch := pseudonymBatch()
+	store := &batchStore{}
+	s := Pseudonymize(store, HMACPseudonyms([]byte("key")), PrivateNetworks)
+	if err := s.Accept(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(batch, pseudonymBatch()) {
+		t.Error("the caller's batch was changed")
+	}
+
+	stored := store.batch
+	raw, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, real := range []string{"10.0.0.1", "laptop.lan", "1.0.0.10.in-addr.arpa", "www.lan", "printer.lan", "192.168.1.20", "2001:db8::1"} {
+		if strings.Contains(string(raw), real) {
+			t.Errorf("stored batch holds %s: %s", real, raw)
+		}
+	}
+
+	client := stored.Clients[0]
+	lookups := stored.Lookups
+	for _, lookup := range lookups[:3] {
+		if lookup.Client != client.IP {
+			t.Errorf("lookup client %q, want %q", lookup.Client, client.IP)
+		}
+	}
+	// Answers outside the client networks are kept.
+	if got := lookups[0]; got.Host != "example.com" || got.AllIPs[0] != "192.0.2.1" || got.Answers[0].Data != "192.0.2.1" {
+		t.Errorf("public lookup stored as %+v", got)
+	}
+	// The PTR lookup of the client resolves its pseudonym to its name's.
+	if got, want := lookups[1].Host, client.IP+".in-addr.arpa"; got != want {
+		t.Errorf("PTR lookup host %q, want %q", got, want)
+	}
+	if got := lookups[1].Answers[0]; got.Name != lookups[1].Host || got.Data != client.Name {
+		t.Errorf("PTR answer %+v, want %s pointing to %s", got, lookups[1].Host, client.Name)
+	}
+	// A local host and its address are replaced as a client's would be.
+	local := lookups[2]
+	if local.FirstIP != local.AllIPs[0] || local.Answers[1].Data != local.AllIPs[0] {
+		t.Errorf("local address pseudonyms differ: %+v", local)
+	}
+	if local.Answers[0].Data != local.Answers[1].Name || local.Host != local.Answers[0].Name {
+		t.Errorf("local names not replaced consistently: %+v", local)
+	}
+	if self := lookups[3]; self.AllIPs[0] != self.Client || self.Host == "self.example.net" {
+		t.Errorf("lookup of a client's own address stored as %+v", self)
+	}
+}
+
+func TestPseudonymizeStoreTruncated(t *testing.T) {
+	store := &batchStore{}
+	s := Pseudonymize(store, TruncatedIPs, PrivateNetworks)
+	if err := s.Accept(context.Background(), pseudonymBatch()); err != nil {
+		t.Fatal(err)
+	}
+	ptr := store.batch.Lookups[1]
+	if ptr.Host != "0.0.0.10.in-addr.arpa" || ptr.Answers[0].Data != "10.0.0.0" {
+		t.Errorf("PTR lookup stored as %+v", ptr)
+	}
+	if local := store.batch.Lookups[2]; local.Host != "192.168.1.0" || local.AllIPs[0] != "192.168.1.0" {
+		t.Errorf("local lookup stored as %+v", local)
+	}
+}
@@ -0,0 +1,111 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrQueueFull   = errors.New("store queue full")
+	ErrQueueClosed = errors.New("store queue closed")
+)
+
+// NewQueueStore returns a Store that queues up to size batches for store and
+// passes them on from its own goroutine, so that a slow or failing store does
+// not hold up the others.  A batch store fails is retried every retry until
+// it is accepted.  Batches arriving while the queue is full are rejected.
+func NewQueueStore(store Store, size int, retry time.Duration) Store {
+	s := &queueStore{
+		store:   store,
+		retry:   retry,
+		batches: make(chan Batch, size),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+type queueStore struct {
+	store   Store
+	retry   time.Duration
+	batches chan Batch
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (s *queueStore) Accept(_ context.Context, batch Batch) error {
+	select {
+	case <-s.done:
+		return ErrQueueClosed
+	default:
+	}
+	select {
+	case s.batches <- batch:
+		metrics.queued.add(1)
+		return nil
+	default:
+		metrics.queueRejected.inc()
+		return errors.Wrapf(ErrQueueFull, "%d batches", cap(s.batches))
+	}
+}
+
+// Close tries the queued batches once more, then closes store.
+func (s *queueStore) Close() error {
+	s.once.Do(func() { close(s.done) })
+	<-s.stopped
+	return s.store.Close()
+}
+
+func (s *queueStore) run() {
+	defer close(s.stopped)
+	for {
+		select {
+		case batch := <-s.batches:
+			s.deliver(batch)
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+// deliver passes batch on, retrying until it is accepted or the queue is
+// closed.
+func (s *queueStore) deliver(batch Batch) {
+	defer metrics.queued.add(-1)
+	for {
+		err := s.store.Accept(context.Background(), batch)
+		if err == nil {
+			return
+		}
+		logger.Warn("queued batch failed", "store", storeName(s.store, 0), "retry", s.retry, "error", err)
+		select {
+		case <-time.After(s.retry):
+		case <-s.done:
+			if err = s.store.Accept(context.Background(), batch); err != nil {
+				logger.Error("dropping queued batch", "store", storeName(s.store, 0), "error", err)
+			}
+			return
+		}
+	}
+}
+
+// flush tries the queued batches once each.
+func (s *queueStore) flush() {
+	for {
+		select {
+		case batch := <-s.batches:
+			metrics.queued.add(-1)
+			if err := s.store.Accept(context.Background(), batch); err != nil {
+				logger.Error("dropping queued batch", "store", storeName(s.store, 0), "error", err)
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Query selects a time range and a page of results.  Zero values do not
+// filter, and a zero Limit returns every result.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Offset int
+}
+
+// Sighting is an answer record aggregated over the lookups it was seen in.
+type Sighting struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Data      string    `json:"data"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int64     `json:"count"`
+}
+
+// HostCount is the number of lookups of a host.
+type HostCount struct {
+	Host  string `json:"host"`
+	Count int64  `json:"count"`
+}
+
+// ClientCount is the number of lookups made by a client.
+type ClientCount struct {
+	IP    string `json:"ip"`
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// Reader is implemented by stores that can be queried for what they
+// recorded.
+type Reader interface {
+	ClientHistory
+
+	// LookupsByHost returns the lookups of host, newest first.
+	LookupsByHost(ctx context.Context, host string, q Query) ([]Lookup, error)
+	// LookupsByClient returns the lookups made by the client ip, newest
+	// first.
+	LookupsByClient(ctx context.Context, ip string, q Query) ([]Lookup, error)
+	// HostsForIP returns the records answering ip, seen during the range,
+	// most recently seen first.
+	HostsForIP(ctx context.Context, ip string, q Query) ([]Sighting, error)
+	// IPsForHost returns the address records answered for host, seen during
+	// the range, most recently seen first.
+	IPsForHost(ctx context.Context, host string, q Query) ([]Sighting, error)
+	// TopHosts returns the most looked up hosts.  The range is counted by
+	// hour: From is rounded down to the hour.
+	TopHosts(ctx context.Context, q Query) ([]HostCount, error)
+	// TopClients returns the clients making the most lookups, counted by
+	// hour like TopHosts.
+	TopClients(ctx context.Context, q Query) ([]ClientCount, error)
+	// SearchHosts returns the recorded hosts matching pattern, sorted.
+	SearchHosts(ctx context.Context, pattern string, q Query) ([]string, error)
+}
+
+// filter builds the WHERE clause and arguments of a query.
+type filter struct {
+	where []string
+	args  []interface{}
+}
+
+func (f *filter) add(clause string, args ...interface{}) {
+	f.where = append(f.where, clause)
+	f.args = append(f.args, args...)
+}
+
+// span restricts the rows whose [first, last] column span overlaps the
+// range of q.
+func (f *filter) span(first, last string, q Query) {
+	if !q.From.IsZero() {
+		f.add(last+" >= ?", q.From.UnixNano())
+	}
+	if !q.To.IsZero() {
+		f.add(first+" < ?", q.To.UnixNano())
+	}
+}
+
+// sql returns query with the WHERE clause, the order and the page of q.
+func (f *filter) sql(query, groupBy, orderBy string, q Query) (string, []interface{}) {
+	if len(f.where) > 0 {
+		query += " WHERE " + strings.Join(f.where, " AND ")
+	}
+	query += groupBy + " ORDER BY " + orderBy
+	args := f.args
+	if q.Limit > 0 || q.Offset > 0 {
+		limit := q.Limit
+		if limit <= 0 {
+			limit = -1
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, q.Offset)
+	}
+	return query, args
+}
+
+const (
+	lookupsQuery   = "SELECT l.ts, c.ip, h.name, l.qtype, (SELECT group_concat(ip) FROM answers WHERE lookup_id = l.id) FROM lookups l JOIN clients c ON c.id = l.client_id JOIN hosts h ON h.id = l.host_id"
+	sightingsQuery = "SELECT rrname, rrtype, rdata, time_first, time_last, count FROM pdns"
+)
+
+func (s *sqliteStore) LookupsByHost(ctx context.Context, host string, q Query) ([]Lookup, error) {
+	f := &filter{}
+	f.add("h.name = ?", host)
+	return s.lookups(ctx, f, q)
+}
+
+func (s *sqliteStore) LookupsByClient(ctx context.Context, ip string, q Query) ([]Lookup, error) {
+	f := &filter{}
+	f.add("c.ip = ?", ip)
+	return s.lookups(ctx, f, q)
+}
+
+func (s *sqliteStore) lookups(ctx context.Context, f *filter, q Query) ([]Lookup, error) {
+	f.span("l.ts", "l.ts", q)
+	query, args := f.sql(lookupsQuery, "", "l.ts DESC", q)
+	var lookups []Lookup
+	err := s.query(ctx, query, args, func(rows *sql.Rows) error {
+		var (
+			ts      int64
+			answers sql.NullString
+			lookup  Lookup
+		)
+		if err := rows.Scan(&ts, &lookup.Client, &lookup.Host, &lookup.Type, &answers); err != nil {
+			return errors.Wrap(err, "scanning lookup")
+		}
+		lookup.When = time.Unix(0, ts)
+		if answers.Valid {
+			lookup.AllIPs = strings.Split(answers.String, ",")
+			lookup.FirstIP = lookup.AllIPs[0]
+		}
+		lookups = append(lookups, lookup)
+		return nil
+	})
+	return lookups, err
+}
+
+func (s *sqliteStore) HostsForIP(ctx context.Context, ip string, q Query) ([]Sighting, error) {
+	f := &filter{}
+	f.add("rdata = ?", ip)
+	return s.sightings(ctx, f, q)
+}
+
+func (s *sqliteStore) IPsForHost(ctx context.Context, host string, q Query) ([]Sighting, error) {
+	f := &filter{}
+	f.add("rrname = ? AND rrtype IN ('A', 'AAAA')", host)
+	return s.sightings(ctx, f, q)
+}
+
+func (s *sqliteStore) sightings(ctx context.Context, f *filter, q Query) ([]Sighting, error) {
+	f.span("time_first", "time_last", q)
+	query, args := f.sql(sightingsQuery, "", "time_last DESC", q)
+	var sightings []Sighting
+	err := s.query(ctx, query, args, func(rows *sql.Rows) error {
+		var (
+			sighting    Sighting
+			first, last int64
+		)
+		if err := rows.Scan(&sighting.Name, &sighting.Type, &sighting.Data, &first, &last, &sighting.Count); err != nil {
+			return errors.Wrap(err, "scanning pdns")
+		}
+		sighting.FirstSeen, sighting.LastSeen = time.Unix(0, first), time.Unix(0, last)
+		sightings = append(sightings, sighting)
+		return nil
+	})
+	return sightings, err
+}
+
+func (s *sqliteStore) TopHosts(ctx context.Context, q Query) ([]HostCount, error) {
+	f := &filter{}
+	f.span("r.bucket", "r.bucket", hourly(q))
+	query, args := f.sql("SELECT h.name, sum(r.count) FROM rollup_hourly r JOIN hosts h ON h.id = r.host_id", " GROUP BY r.host_id", "2 DESC, 1", q)
+	var counts []HostCount
+	err := s.query(ctx, query, args, func(rows *sql.Rows) error {
+		var count HostCount
+		if err := rows.Scan(&count.Host, &count.Count); err != nil {
+			return errors.Wrap(err, "scanning host count")
+		}
+		counts = append(counts, count)
+		return nil
+	})
+	return counts, err
+}
+
+func (s *sqliteStore) TopClients(ctx context.Context, q Query) ([]ClientCount, error) {
+	f := &filter{}
+	f.span("r.bucket", "r.bucket", hourly(q))
+	query, args := f.sql("SELECT c.ip, c.name, sum(r.count) FROM rollup_hourly r JOIN clients c ON c.id = r.client_id", " GROUP BY r.client_id", "3 DESC, 1", q)
+	var counts []ClientCount
+	err := s.query(ctx, query, args, func(rows *sql.Rows) error {
+		var count ClientCount
+		if err := rows.Scan(&count.IP, &count.Name, &count.Count); err != nil {
+			return errors.Wrap(err, "scanning client count")
+		}
+		counts = append(counts, count)
+		return nil
+	})
+	return counts, err
+}
+
+// hourly rounds the start of the range of q down to its hourly bucket.
+func hourly(q Query) Query {
+	if !q.From.IsZero() {
+		q.From = time.Unix(0, bucket(q.From.UnixNano(), hour))
+	}
+	return q
+}
+
+// query runs query and calls scan for every row.
+func (s *sqliteStore) query(ctx context.Context, query string, args []interface{}, scan func(*sql.Rows) error) error {
+	db, err := s.reader()
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "querying sqlite db")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "reading rows")
+}
@@ -0,0 +1,221 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownScheme = errors.New("no store registered for scheme")
+
+// StoreFactory returns the Store described by u.
+type StoreFactory func(u *url.URL) (Store, error)
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]StoreFactory{}
+)
+
+// RegisterStore makes factory available to OpenStore for URLs with scheme.
+// It panics if scheme is already registered.
+func RegisterStore(scheme string, factory StoreFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[scheme]; ok {
+		panic("nsrecorder: RegisterStore called twice for scheme " + scheme)
+	}
+	registry[scheme] = factory
+}
+
+// StoreSchemes returns the registered schemes, sorted.
+func StoreSchemes() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// OpenStore returns the Store described by rawURL, created by the factory
+// registered for its scheme.
+func OpenStore(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing store url")
+	}
+	registryMu.Lock()
+	factory, ok := registry[u.Scheme]
+	registryMu.Unlock()
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownScheme, "%q", u.Scheme)
+	}
+	store, err := factory(u)
+	return store, errors.Wrapf(err, "opening %s store", u.Scheme)
+}
+
+func init() {
+	RegisterStore("sqlite", openSQLiteStore)
+	RegisterStore("postgres", openPostgresStore)
+	RegisterStore("postgresql", openPostgresStore)
+	RegisterStore("jsonl", openArchiveStore)
+	RegisterStore("nsq", openNSQStore)
+	RegisterStore("http", openWebhookStore)
+	RegisterStore("https", openWebhookStore)
+	RegisterStore("log", openLogStore)
+}
+
+// urlPath returns the file path of u, relative if u has a host, as in
+// sqlite://nsr.db, absolute otherwise, as in sqlite:///var/lib/data/nsr.db.
+func urlPath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+// openSQLiteStore accepts the journal_mode, synchronous, busy_timeout,
+// partition and repeated pragma parameters, and wal=0 or wal=1 as a
+// shorthand for the journal mode.
+func openSQLiteStore(u *url.URL) (Store, error) {
+	q := u.Query()
+	opts := DefaultSQLiteOptions
+	if wal := q.Get("wal"); wal != "" {
+		on, err := strconv.ParseBool(wal)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing wal")
+		}
+		opts.JournalMode = "DELETE"
+		if on {
+			opts.JournalMode = "WAL"
+		}
+	}
+	if mode := q.Get("journal_mode"); mode != "" {
+		opts.JournalMode = mode
+	}
+	if synchronous := q.Get("synchronous"); synchronous != "" {
+		opts.Synchronous = synchronous
+	}
+	if timeout := q.Get("busy_timeout"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing busy_timeout")
+		}
+		opts.BusyTimeout = d
+	}
+	opts.Pragmas = q["pragma"]
+	if partition := q.Get("partition"); partition != "" {
+		if !partitioning(partition).valid() {
+			return nil, errors.Wrapf(ErrUnknownPartition, "%q", partition)
+		}
+		opts.Partition = partition
+	}
+	return NewSQLiteStoreWithOptions(urlPath(u), opts), nil
+}
+
+// openPostgresStore passes the url on to the driver unchanged.
+func openPostgresStore(u *url.URL) (Store, error) {
+	return NewPostgresStore(u.String()), nil
+}
+
+// openArchiveStore accepts the max_bytes, interval, compression, max_files
+// and max_age parameters, which default to DefaultArchiveOptions.  Rotated
+// files are gzipped unless compression is zstd or none.
+func openArchiveStore(u *url.URL) (Store, error) {
+	q := u.Query()
+	opts := DefaultArchiveOptions
+	var err error
+	if q.Get("max_bytes") != "" {
+		if opts.MaxBytes, err = int64Param(q, "max_bytes"); err != nil {
+			return nil, err
+		}
+	}
+	if q.Get("interval") != "" {
+		if opts.Interval, err = durationParam(q, "interval"); err != nil {
+			return nil, err
+		}
+	}
+	if compression, ok := q["compression"]; ok {
+		opts.Compression = compression[0]
+		if opts.Compression == "none" {
+			opts.Compression = ""
+		}
+	}
+	maxFiles, err := int64Param(q, "max_files")
+	if err != nil {
+		return nil, err
+	}
+	opts.MaxFiles = int(maxFiles)
+	if opts.MaxAge, err = durationParam(q, "max_age"); err != nil {
+		return nil, err
+	}
+	return NewArchiveStore(urlPath(u), opts)
+}
+
+// openNSQStore publishes to the topic named by the host of u, as in
+// nsq://dns-lookups?nsqd=127.0.0.1:4150.
+func openNSQStore(u *url.URL) (Store, error) {
+	topic := u.Host
+	if topic == "" {
+		return nil, errors.New("missing topic")
+	}
+	addr := u.Query().Get("nsqd")
+	if addr == "" {
+		addr = "127.0.0.1:4150"
+	}
+	return NewNSQStore(addr, topic)
+}
+
+// openWebhookStore POSTs to u with the default options.
+func openWebhookStore(u *url.URL) (Store, error) {
+	return NewWebhookStore(u.String()), nil
+}
+
+// openLogStore accepts format=text or json and a level, and logs to stderr at
+// that level.
+func openLogStore(u *url.URL) (Store, error) {
+	q := u.Query()
+	if q.Get("format") == "" && q.Get("level") == "" {
+		return NewLogStore(), nil
+	}
+	level := LevelInfo
+	if name := q.Get("level"); name != "" {
+		var err error
+		if level, err = ParseLevel(name); err != nil {
+			return nil, err
+		}
+	}
+	switch format := q.Get("format"); format {
+	case "", "text", "json":
+		return NewLogStoreWithLogger(NewLogger(os.Stderr, level, format == "json"), level), nil
+	default:
+		return nil, errors.Errorf("unknown log format %q", format)
+	}
+}
+
+func int64Param(q url.Values, name string) (int64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return n, errors.Wrapf(err, "parsing %s", name)
+}
+
+func durationParam(q url.Values, name string) (time.Duration, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	return d, errors.Wrapf(err, "parsing %s", name)
+}
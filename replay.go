@@ -0,0 +1,155 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Publisher is the subset of *nsq.Producer needed to replay lookups.
+type Publisher interface {
+	Publish(topic string, body []byte) error
+}
+
+// ReplayFilter selects the recorded lookups to replay.  Zero values do not
+// filter.
+type ReplayFilter struct {
+	From   time.Time
+	To     time.Time
+	Client string
+	Host   string
+	Limit  int
+}
+
+// Replay publishes the lookups recorded in the sqlite db at path that match
+// filter to topic, as messages compatible with the ones published by nspub.
+// A speed of 1 reproduces the original pacing, 2 replays twice as fast, and
+// 0 publishes as fast as possible.  It returns the number of published
+// messages.
+func Replay(ctx context.Context, path string, filter ReplayFilter, pub Publisher, topic string, speed float64) (int, error) {
+	return ReplayWithOptions(ctx, path, DefaultSQLiteOptions, filter, pub, topic, speed)
+}
+
+// ReplayWithOptions is Replay opening the db with opts.
+func ReplayWithOptions(ctx context.Context, path string, opts SQLiteOptions, filter ReplayFilter, pub Publisher, topic string, speed float64) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, errors.Wrap(err, "checking sqlite db")
+	}
+	db, err := openSQLiteDB(path, opts)
+	if err != nil {
+		return 0, errors.Wrap(err, "opening sqlite3 db connection")
+	}
+	defer db.Close()
+
+	if err = checkSchema(db); err != nil {
+		return 0, err
+	}
+
+	query, args := replayQuery(filter)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, errors.Wrap(err, "querying lookups")
+	}
+	defer rows.Close()
+
+	var (
+		published int
+		previous  time.Time
+	)
+	for rows.Next() {
+		var (
+			ts      int64
+			answers sql.NullString
+		)
+		lookup := Lookup{}
+		if err = rows.Scan(&ts, &lookup.Client, &lookup.Host, &lookup.Type, &answers); err != nil {
+			return published, errors.Wrap(err, "scanning lookup")
+		}
+		lookup.When = time.Unix(0, ts)
+		if answers.Valid {
+			lookup.AllIPs = strings.Split(answers.String, ",")
+		}
+
+		if speed > 0 && !previous.IsZero() && lookup.When.After(previous) {
+			delay := time.Duration(float64(lookup.When.Sub(previous)) / speed)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return published, ctx.Err()
+			}
+		}
+		previous = lookup.When
+
+		body, err := json.Marshal(lookupMessage(lookup))
+		if err != nil {
+			return published, errors.Wrap(err, "marshaling message")
+		}
+		if err = pub.Publish(topic, body); err != nil {
+			return published, errors.Wrap(err, "publishing message")
+		}
+		published++
+	}
+	return published, errors.Wrap(rows.Err(), "reading lookups")
+}
+
+func replayQuery(filter ReplayFilter) (string, []interface{}) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if !filter.From.IsZero() {
+		where = append(where, "l.ts >= ?")
+		args = append(args, filter.From.UnixNano())
+	}
+	if !filter.To.IsZero() {
+		where = append(where, "l.ts < ?")
+		args = append(args, filter.To.UnixNano())
+	}
+	if filter.Client != "" {
+		where = append(where, "c.ip = ?")
+		args = append(args, filter.Client)
+	}
+	if filter.Host != "" {
+		where = append(where, "h.name LIKE ?")
+		args = append(args, "%"+filter.Host+"%")
+	}
+	query := "SELECT l.ts, c.ip, h.name, l.qtype, (SELECT group_concat(ip) FROM answers WHERE lookup_id = l.id) FROM lookups l JOIN clients c ON c.id = l.client_id JOIN hosts h ON h.id = l.host_id"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY l.ts"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	return query, args
+}
+
+// lookupMessage is the inverse of parse.
+func lookupMessage(lookup Lookup) Message {
+	msg := Message{ClientIP: lookup.Client, Time: lookup.When}
+	hosts := strings.Split(lookup.Host, ",")
+	types := strings.Split(lookup.Type, ",")
+	for x, host := range hosts {
+		question := Question{Name: host}
+		if x < len(types) {
+			question.Qtype = typeNumber(types[x])
+		}
+		msg.Msg.Question = append(msg.Msg.Question, question)
+	}
+	for _, ip := range lookup.AllIPs {
+		answer := Answer{Hdr: Header{Name: hosts[0]}}
+		if strings.Contains(ip, ":") {
+			answer.AAAA = ip
+		} else {
+			answer.A = ip
+		}
+		msg.Msg.Answer = append(msg.Msg.Answer, answer)
+	}
+	return msg
+}
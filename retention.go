@@ -0,0 +1,187 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	hour = int64(time.Hour)
+	day  = 24 * hour
+
+	// pruneChunk bounds the rows deleted per transaction, so that batches
+	// can be stored while a large backlog is pruned.
+	pruneChunk = 10000
+)
+
+// bucket returns the start of the bucket of size width holding ts.
+func bucket(ts, width int64) int64 { return ts - ts%width }
+
+// RetentionPolicy says for how long each kind of data is kept.  Zero keeps
+// it forever.
+type RetentionPolicy struct {
+	Lookups time.Duration
+	Hourly  time.Duration
+	Daily   time.Duration
+	// PDNS and ClientNames apply to passive DNS sightings and client name
+	// spans, by when they were last seen.
+	PDNS        time.Duration
+	ClientNames time.Duration
+}
+
+// PruneResult counts the rows deleted by a Prune.
+type PruneResult struct {
+	Lookups int64
+	Hourly  int64
+	Daily   int64
+	// Related counts the passive DNS, client name, reverse, host and client
+	// rows of a sqlite db deleted along with the lookups and rollups.
+	Related int64
+	// Partitions counts the files deleted from a partitioned sqlite db.
+	Partitions int64
+}
+
+// Pruner is implemented by stores that can delete data older than a
+// RetentionPolicy allows.
+type Pruner interface {
+	Prune(ctx context.Context, policy RetentionPolicy, now time.Time) (PruneResult, error)
+}
+
+// PruneEvery prunes p according to policy every interval until ctx is done.
+func PruneEvery(ctx context.Context, p Pruner, policy RetentionPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result, err := p.Prune(ctx, policy, time.Now())
+		if err != nil {
+			logger.Error("pruning", "error", err)
+		} else {
+			logger.Info("pruned", "lookups", result.Lookups, "hourly", result.Hourly, "daily", result.Daily, "related", result.Related, "partitions", result.Partitions)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pruneQueries delete at most a chunk of rows older than a cutoff.
+var pruneQueries = map[string]string{
+	"answers": "DELETE FROM answers WHERE lookup_id IN (SELECT id FROM lookups WHERE ts < ? ORDER BY ts LIMIT ?)",
+	"lookups": "DELETE FROM lookups WHERE id IN (SELECT id FROM lookups WHERE ts < ? ORDER BY ts LIMIT ?)",
+	"rollup_hourly": "DELETE FROM rollup_hourly WHERE (bucket, client_id, host_id, qtype) IN " +
+		"(SELECT bucket, client_id, host_id, qtype FROM rollup_hourly WHERE bucket < ? LIMIT ?)",
+	"rollup_daily": "DELETE FROM rollup_daily WHERE (bucket, client_id, host_id, qtype) IN " +
+		"(SELECT bucket, client_id, host_id, qtype FROM rollup_daily WHERE bucket < ? LIMIT ?)",
+	"pdns": "DELETE FROM pdns WHERE (rrname, rrtype, rdata) IN " +
+		"(SELECT rrname, rrtype, rdata FROM pdns WHERE time_last < ? LIMIT ?)",
+	"client_names": "DELETE FROM client_names WHERE (ip, first_seen) IN " +
+		"(SELECT ip, first_seen FROM client_names WHERE last_seen < ? LIMIT ?)",
+}
+
+// orphanQueries delete at most a chunk of rows that no lookup or rollup
+// refers to any more.  reverse has no time of its own; a pair is kept while
+// an answer of a lookup of the host holds the ip.
+var orphanQueries = map[string]string{
+	"reverse": "DELETE FROM reverse WHERE rowid IN (SELECT r.rowid FROM reverse r WHERE NOT EXISTS " +
+		"(SELECT 1 FROM answers a JOIN lookups l ON l.id = a.lookup_id JOIN hosts h ON h.id = l.host_id WHERE a.ip = r.ip AND h.name = r.name) LIMIT ?)",
+	"hosts": "DELETE FROM hosts WHERE id IN (SELECT id FROM hosts WHERE id NOT IN " +
+		"(SELECT host_id FROM lookups UNION SELECT host_id FROM rollup_hourly UNION SELECT host_id FROM rollup_daily) LIMIT ?)",
+	"clients": "DELETE FROM clients WHERE id IN (SELECT id FROM clients WHERE id NOT IN " +
+		"(SELECT client_id FROM lookups UNION SELECT client_id FROM rollup_hourly UNION SELECT client_id FROM rollup_daily) LIMIT ?)",
+}
+
+// Prune deletes the lookups, rollups, passive DNS sightings and client name
+// spans older than their retention.  Then it deletes the reverse pairs, hosts
+// and clients nothing refers to any more.
+func (s *sqliteStore) Prune(ctx context.Context, policy RetentionPolicy, now time.Time) (PruneResult, error) {
+	var (
+		result PruneResult
+		err    error
+	)
+	if policy == (RetentionPolicy{}) {
+		return result, nil
+	}
+	if policy.Lookups > 0 {
+		cutoff := now.Add(-policy.Lookups).UnixNano()
+		if result.Lookups, err = s.prune(ctx, cutoff, "answers", "lookups"); err != nil {
+			return result, err
+		}
+	}
+	if policy.Hourly > 0 {
+		if result.Hourly, err = s.prune(ctx, now.Add(-policy.Hourly).UnixNano(), "rollup_hourly"); err != nil {
+			return result, err
+		}
+	}
+	if policy.Daily > 0 {
+		if result.Daily, err = s.prune(ctx, now.Add(-policy.Daily).UnixNano(), "rollup_daily"); err != nil {
+			return result, err
+		}
+	}
+	for table, retention := range map[string]time.Duration{"pdns": policy.PDNS, "client_names": policy.ClientNames} {
+		if retention <= 0 {
+			continue
+		}
+		n, err := s.prune(ctx, now.Add(-retention).UnixNano(), table)
+		result.Related += n
+		if err != nil {
+			return result, err
+		}
+	}
+	for _, table := range []string{"reverse", "hosts", "clients"} {
+		n, err := s.prune(ctx, 0, table)
+		result.Related += n
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// prune deletes the rows before cutoff from tables, or the orphaned rows of
+// a table of orphanQueries, a chunk at a time, each chunk in its own
+// transaction.
+func (s *sqliteStore) prune(ctx context.Context, cutoff int64, tables ...string) (int64, error) {
+	var total int64
+	for {
+		n, err := s.pruneChunk(ctx, cutoff, tables...)
+		total += n
+		if err != nil || n < pruneChunk {
+			return total, err
+		}
+	}
+}
+
+// pruneChunk runs the prune statements of tables in one transaction, and
+// returns the number of rows deleted from the last one.
+func (s *sqliteStore) pruneChunk(ctx context.Context, cutoff int64, tables ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return 0, errors.Wrap(err, "opening connection to sqlite db")
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "beginning transaction")
+	}
+	var n int64
+	for _, table := range tables {
+		query, args := pruneQueries[table], []interface{}{cutoff, pruneChunk}
+		if orphans, ok := orphanQueries[table]; ok {
+			query, args = orphans, []interface{}{pruneChunk}
+		}
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err == nil {
+			n, err = result.RowsAffected()
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, errors.Wrapf(err, "pruning %s", table)
+		}
+	}
+	return n, errors.Wrap(tx.Commit(), "committing prune")
+}
@@ -0,0 +1,88 @@
+package nsrecorder
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLitePruneKeepsAggregates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nsr.db")
+	store := NewSQLiteStore(path)
+	defer store.Close()
+
+	ctx := context.Background()
+	now := time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+	batch := Batch{
+		Clients: []Client{{IP: "10.0.0.1", Name: "laptop"}},
+		Lookups: []Lookup{
+			{When: now.AddDate(0, 0, -40), Client: "10.0.0.1", Host: "old.example.com", Type: "A", AllIPs: []string{"192.0.2.1"}},
+			{When: now.Add(-time.Hour), Client: "10.0.0.1", Host: "new.example.com", Type: "A", AllIPs: []string{"192.0.2.2"}},
+		},
+	}
+	if err = store.Accept(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count := func(query string) int64 {
+		t.Helper()
+		var n int64
+		if err := db.QueryRow(query).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return n
+	}
+	check := func(want map[string]int64) {
+		t.Helper()
+		for query, n := range want {
+			if got := count(query); got != n {
+				t.Errorf("%s = %d, want %d", query, got, n)
+			}
+		}
+	}
+
+	pruner := store.(Pruner)
+	result, err := pruner.Prune(ctx, RetentionPolicy{Lookups: 720 * time.Hour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Lookups != 1 {
+		t.Errorf("pruned %d lookups, want 1", result.Lookups)
+	}
+	// The lookup of old.example.com goes, its sighting and rollups stay.
+	check(map[string]int64{
+		"SELECT count(*) FROM lookups":                                1,
+		"SELECT count(*) FROM pdns WHERE rrname = 'old.example.com'":  1,
+		"SELECT count(*) FROM rollup_hourly":                          2,
+		"SELECT count(*) FROM rollup_daily":                           2,
+		"SELECT count(*) FROM client_names":                           1,
+		"SELECT count(*) FROM hosts WHERE name = 'old.example.com'":   1,
+		"SELECT count(*) FROM reverse WHERE name = 'old.example.com'": 0,
+		"SELECT count(*) FROM reverse WHERE name = 'new.example.com'": 1,
+		"SELECT count(*) FROM pdns WHERE rrname = 'new.example.com'":  1,
+	})
+
+	// Their own retentions delete sightings and name spans.
+	if _, err = pruner.Prune(ctx, RetentionPolicy{PDNS: 720 * time.Hour, ClientNames: 30 * time.Minute}, now); err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]int64{
+		"SELECT count(*) FROM pdns":         1,
+		"SELECT count(*) FROM client_names": 0,
+		"SELECT count(*) FROM lookups":      1,
+	})
+}
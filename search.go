@@ -0,0 +1,167 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoFTS5 reports a db with a host search index opened for writing by a
+// binary built without FTS5.
+var ErrNoFTS5 = errors.New("db has a host search index, which needs a binary built with the sqlite_fts5 tag")
+
+// The host search index is an FTS5 table over hosts.name, kept in sync by
+// triggers.  FTS5 is only compiled in with the sqlite_fts5 build tag, so
+// the index is not part of the versioned schema: it is created when the db
+// is opened for writing by a binary that has FTS5.  A binary without FTS5
+// can not run the triggers, and refuses to write to a db that has the index
+// rather than dropping it.  Searches scan hosts while there is no index.
+var (
+	createHostIndex = []string{
+		"CREATE VIRTUAL TABLE IF NOT EXISTS hosts_fts USING fts5 (name, content = 'hosts', content_rowid = 'id')",
+		"CREATE TRIGGER hosts_fts_insert AFTER INSERT ON hosts BEGIN INSERT INTO hosts_fts (rowid, name) VALUES (new.id, new.name); END",
+		"CREATE TRIGGER hosts_fts_delete AFTER DELETE ON hosts BEGIN INSERT INTO hosts_fts (hosts_fts, rowid, name) VALUES ('delete', old.id, old.name); END",
+		"INSERT INTO hosts_fts (hosts_fts) VALUES ('rebuild')",
+	}
+	dropHostIndexTriggers = []string{
+		"DROP TRIGGER IF EXISTS hosts_fts_insert",
+		"DROP TRIGGER IF EXISTS hosts_fts_delete",
+	}
+)
+
+// hostIndexed says whether db has a host search index the linked sqlite can
+// use, without changing it.
+func hostIndexed(db *sql.DB) (bool, error) {
+	var fts5, triggers int
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return false, errors.Wrap(err, "checking for fts5")
+	}
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'hosts_fts_%'").Scan(&triggers); err != nil {
+		return false, errors.Wrap(err, "checking host index")
+	}
+	return fts5 == 1 && triggers == len(dropHostIndexTriggers), nil
+}
+
+// hostIndex creates the host search index if the linked sqlite has FTS5,
+// completes one left partial, and says whether it can be used.
+func hostIndex(db *sql.DB) (bool, error) {
+	var fts5, triggers int
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return false, errors.Wrap(err, "checking for fts5")
+	}
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'hosts_fts_%'").Scan(&triggers); err != nil {
+		return false, errors.Wrap(err, "checking host index")
+	}
+
+	switch {
+	case fts5 == 1 && triggers == len(dropHostIndexTriggers):
+		return true, nil
+	case fts5 != 1 && triggers == 0:
+		return false, nil
+	case fts5 != 1:
+		return false, ErrNoFTS5
+	}
+	logger.Info("building host search index", "store", "sqlite")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "beginning transaction")
+	}
+	for _, statement := range append(dropHostIndexTriggers, createHostIndex...) {
+		if _, err = tx.Exec(statement); err != nil {
+			_ = tx.Rollback()
+			return false, errors.Wrapf(err, "executing %q", statement)
+		}
+	}
+	return true, errors.Wrap(tx.Commit(), "committing host index")
+}
+
+// SearchHosts returns the recorded hosts matching pattern, sorted, paginated
+// by q; its time range is not used.  A pattern holding * or ? is matched
+// against whole names with GLOB, as in *.tracking.*.  Any other pattern
+// matches the names holding it from the start of a label: cdn matches
+// cdn.example.com and a.cdn2.example.net, not xcdn.example.com.  Matching
+// ignores case, as DNS names do.
+func (s *sqliteStore) SearchHosts(ctx context.Context, pattern string, q Query) ([]string, error) {
+	if pattern == "" {
+		return nil, errors.New("empty search pattern")
+	}
+	glob := pattern
+	if !strings.ContainsAny(pattern, "*?") {
+		glob = "*" + pattern + "*"
+	}
+
+	if _, err := s.reader(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	indexed := s.indexed
+	s.mu.Unlock()
+
+	f := &filter{}
+	f.add("lower(h.name) GLOB lower(?)", glob)
+	query := "SELECT h.name FROM hosts h"
+	if match := ftsQuery(pattern); indexed && match != "" {
+		query = "SELECT h.name FROM hosts_fts JOIN hosts h ON h.id = hosts_fts.rowid"
+		f.add("hosts_fts MATCH ?", match)
+	} else if glob != pattern && isToken(pattern[0]) {
+		// Without the index, the start of a label is checked by GLOB.
+		f = &filter{}
+		f.add("(lower(h.name) GLOB lower(?) OR lower(h.name) GLOB lower(?))", pattern+"*", "*[^a-z0-9]"+pattern+"*")
+	}
+	query, args := f.sql(query, "", "h.name", q)
+
+	var hosts []string
+	err := s.query(ctx, query, args, func(rows *sql.Rows) error {
+		var host string
+		if err := rows.Scan(&host); err != nil {
+			return errors.Wrap(err, "scanning host")
+		}
+		hosts = append(hosts, host)
+		return nil
+	})
+	return hosts, err
+}
+
+// ftsQuery returns an FTS5 query matching a superset of the names pattern
+// matches, or "" if the index cannot narrow the search.  The tokenizer
+// splits names into labels at anything but letters and digits; each run of
+// labels between wildcards becomes a phrase.  A token right after a
+// wildcard may start mid-label and is left out, and a token right before
+// one, or at the end of a pattern without wildcards, is a prefix.
+func ftsQuery(pattern string) string {
+	if strings.Contains(pattern, "[") {
+		return ""
+	}
+	wildcards := strings.ContainsAny(pattern, "*?")
+	var phrases []string
+	for start := 0; start < len(pattern); {
+		end := start + strings.IndexAny(pattern[start:], "*?")
+		if end < start {
+			end = len(pattern)
+		}
+		if fragment := pattern[start:end]; fragment != "" {
+			tokens := strings.FieldsFunc(fragment, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+			if start > 0 && len(tokens) > 0 && isToken(fragment[0]) {
+				tokens = tokens[1:]
+			}
+			if len(tokens) > 0 {
+				phrase := `"` + strings.Join(tokens, " ") + `"`
+				if isToken(fragment[len(fragment)-1]) && (end < len(pattern) || !wildcards) {
+					phrase += "*"
+				}
+				phrases = append(phrases, phrase)
+			}
+		}
+		start = end + 1
+	}
+	return strings.Join(phrases, " AND ")
+}
+
+func isToken(b byte) bool {
+	r := rune(b)
+	return b >= 0x80 || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,73 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package nsrecorder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchHostsIndexed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewSQLiteStore(filepath.Join(dir, "nsr.db"))
+	defer store.Close()
+
+	ctx := context.Background()
+	accept := func(hosts ...string) {
+		t.Helper()
+		batch := Batch{}
+		for _, host := range hosts {
+			batch.Lookups = append(batch.Lookups, Lookup{When: time.Now(), Client: "10.0.0.1", Host: host, Type: "A"})
+		}
+		if err := store.Accept(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accept("cdn.example.com", "xcdn.example.com")
+
+	reads, err := store.(*sqliteStore).reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed, err := hostIndexed(reads); err != nil || !indexed {
+		t.Fatalf("hostIndexed = %v, %v, want an index", indexed, err)
+	}
+	// Hosts inserted after the index was built are indexed by the triggers.
+	accept("a.CDN2.example.net", "ads.tracking.example.org")
+	var indexedHosts int
+	if err = reads.QueryRow("SELECT count(*) FROM hosts_fts WHERE hosts_fts MATCH 'example'").Scan(&indexedHosts); err != nil {
+		t.Fatal(err)
+	}
+	if indexedHosts != 4 {
+		t.Errorf("%d hosts indexed, want 4", indexedHosts)
+	}
+
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"cdn", []string{"a.CDN2.example.net", "cdn.example.com"}},
+		{"cdn.example", []string{"cdn.example.com"}},
+		{"*.tracking.*", []string{"ads.tracking.example.org"}},
+		{"*cdn*", []string{"a.CDN2.example.net", "cdn.example.com", "xcdn.example.com"}},
+	} {
+		hosts, err := store.(Reader).SearchHosts(ctx, tc.pattern, Query{})
+		if err != nil {
+			t.Errorf("SearchHosts(%q): %v", tc.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(hosts, tc.want) {
+			t.Errorf("SearchHosts(%q) = %q, want %q", tc.pattern, hosts, tc.want)
+		}
+	}
+}
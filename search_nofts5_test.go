@@ -0,0 +1,56 @@
+//go:build !sqlite_fts5
+// +build !sqlite_fts5
+
+package nsrecorder
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHostIndexKeptWithoutFTS5(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nsr.db")
+	ctx := context.Background()
+	batch := Batch{Lookups: []Lookup{{When: time.Now(), Client: "10.0.0.1", Host: "example.com", Type: "A"}}}
+
+	store := NewSQLiteStore(path)
+	if err = store.Accept(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A trigger stands in for the index a binary with FTS5 would build.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(createHostIndex[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	store = NewSQLiteStore(path)
+	defer store.Close()
+	if err = store.Accept(ctx, batch); err == nil {
+		t.Error("no error writing to a db with a host index without fts5")
+	}
+	var triggers int
+	if err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'trigger'").Scan(&triggers); err != nil {
+		t.Fatal(err)
+	}
+	if triggers != 1 {
+		t.Errorf("%d triggers left, want the index kept", triggers)
+	}
+}
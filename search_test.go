@@ -0,0 +1,78 @@
+package nsrecorder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFTSQuery(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, want string
+	}{
+		{"cdn", `"cdn"*`},
+		{"cdn.example", `"cdn example"*`},
+		{"cdn.", `"cdn"`},
+		{".com", `"com"*`},
+		{"ads*", `"ads"*`},
+		{"*.tracking.*", `"tracking"`},
+		{"*.Example.COM", `"Example COM"`},
+		{"foo-bar*baz", `"foo bar"*`},
+		{"*.ads.*.example.*", `"ads" AND "example"`},
+		{"a?b", `"a"*`},
+		// A token right after a wildcard may start mid-label.
+		{"*ads", ""},
+		{"*ads.example.com", `"example com"`},
+		{"*", ""},
+		{"?", ""},
+		{"[ab]*", ""},
+	} {
+		if got := ftsQuery(tc.pattern); got != tc.want {
+			t.Errorf("ftsQuery(%q) = %q, want %q", tc.pattern, got, tc.want)
+		}
+	}
+}
+
+func TestSearchHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewSQLiteStore(filepath.Join(dir, "nsr.db"))
+	defer store.Close()
+
+	ctx := context.Background()
+	batch := Batch{}
+	for _, host := range []string{"cdn.example.com", "A.CDN2.example.net", "xcdn.example.com", "ads.Tracking.example.org", "example.com"} {
+		batch.Lookups = append(batch.Lookups, Lookup{When: time.Now(), Client: "10.0.0.1", Host: host, Type: "A"})
+	}
+	if err = store.Accept(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"cdn", []string{"A.CDN2.example.net", "cdn.example.com"}},
+		{"CDN", []string{"A.CDN2.example.net", "cdn.example.com"}},
+		{"*.tracking.*", []string{"ads.Tracking.example.org"}},
+		{"*.EXAMPLE.com", []string{"cdn.example.com", "xcdn.example.com"}},
+		{"*cdn*", []string{"A.CDN2.example.net", "cdn.example.com", "xcdn.example.com"}},
+		{"nothing", nil},
+	} {
+		hosts, err := store.(Reader).SearchHosts(ctx, tc.pattern, Query{})
+		if err != nil {
+			t.Errorf("SearchHosts(%q): %v", tc.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(hosts, tc.want) {
+			t.Errorf("SearchHosts(%q) = %q, want %q", tc.pattern, hosts, tc.want)
+		}
+	}
+}
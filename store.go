@@ -1,23 +1,75 @@
 package nsrecorder // import "jw4.us/nsrecorder"
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	sqlite3 "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
+// Store records the batches of lookups parsed by a Watcher.  Close is called
+// once the watcher has stopped, after the last batch.
 type Store interface {
+	Accept(context.Context, Batch) error
+	Close() error
+}
+
+// HealthChecker is implemented by stores that can tell whether they are able
+// to accept batches.
+type HealthChecker interface {
+	Healthy(context.Context) error
+}
+
+// LegacyStore is the Store interface of earlier versions.
+type LegacyStore interface {
 	Accept([]Client, []Lookup) error
 }
 
+// AdaptStore returns a Store passing batches on to store.  Its Close closes
+// store if it is an io.Closer.
+func AdaptStore(store LegacyStore) Store {
+	return legacyStore{store: store}
+}
+
+type legacyStore struct {
+	store LegacyStore
+}
+
+func (s legacyStore) Accept(_ context.Context, batch Batch) error {
+	return s.store.Accept(batch.Clients, batch.Lookups)
+}
+
+func (s legacyStore) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Batch holds the clients and lookups parsed from a batch of messages.
+type Batch struct {
+	Clients []Client `json:"clients"`
+	Lookups []Lookup `json:"lookups"`
+}
+
+// clientNames maps the client IPs of b to their names.
+func (b Batch) clientNames() map[string]string {
+	names := map[string]string{}
+	for _, client := range b.Clients {
+		names[client.IP] = client.Name
+	}
+	return names
+}
+
 type Client struct {
 	Name string `json:"name"`
 	IP   string `json:"ip"`
@@ -30,165 +82,647 @@ type Lookup struct {
 	Type    string    `json:"type"`
 	FirstIP string    `json:"first_ip"`
 	AllIPs  []string  `json:"all_ips"`
+	Answers []Record  `json:"answers"`
+}
+
+// Record is a resource record from the answer section of a lookup.
+type Record struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Data string `json:"data"`
 }
 
+// records returns the answers of l, or records for its IPs if it has no
+// answers, as is the case for lookups recorded by older versions.
+func (l Lookup) records() []Record {
+	if len(l.Answers) > 0 || len(l.AllIPs) == 0 {
+		return l.Answers
+	}
+	records := make([]Record, 0, len(l.AllIPs))
+	for _, ip := range l.AllIPs {
+		rrtype := "A"
+		if strings.Contains(ip, ":") {
+			rrtype = "AAAA"
+		}
+		records = append(records, Record{Name: l.Host, Type: rrtype, Data: ip})
+	}
+	return records
+}
+
+// MultiStore returns a Store passing every batch to all of stores
+// concurrently.  It fails if any of them fails, with a StoreErrors holding the
+// error of each failed store; wrap a store with BestEffort so that its
+// failures do not fail the batch.
 func MultiStore(stores ...Store) Store {
 	return multiStore(stores)
 }
 
 type multiStore []Store
 
-func (s multiStore) Accept(clients []Client, lookups []Lookup) error {
-	for _, store := range s {
-		if err := store.Accept(clients, lookups); err != nil {
-			return errors.Wrap(err, "multi store Accept")
+func (s multiStore) Accept(ctx context.Context, batch Batch) error {
+	return s.each(func(store Store) error { return store.Accept(ctx, batch) })
+}
+
+// Close closes every store, even if some fail to.
+func (s multiStore) Close() error {
+	return s.each(Store.Close)
+}
+
+func (s multiStore) Healthy(ctx context.Context) error {
+	return s.each(func(store Store) error {
+		if checker, ok := store.(HealthChecker); ok {
+			return checker.Healthy(ctx)
 		}
+		return nil
+	})
+}
+
+// each calls fn with every store concurrently, and collects the errors.
+func (s multiStore) each(fn func(Store) error) error {
+	errs := make([]error, len(s))
+	var wg sync.WaitGroup
+	for x, store := range s {
+		wg.Add(1)
+		go func(x int, store Store) {
+			defer wg.Done()
+			errs[x] = fn(store)
+		}(x, store)
+	}
+	wg.Wait()
+
+	failed := StoreErrors{}
+	for x, err := range errs {
+		if err != nil {
+			failed[storeName(s[x], x)] = err
+		}
+	}
+	if len(failed) > 0 {
+		return failed
 	}
 	return nil
 }
 
-func NewLogStore() Store {
-	return &logStore{}
+// StoreErrors holds the errors of the failed stores of a MultiStore, by the
+// name given to NamedStore, or by position for unnamed stores.
+type StoreErrors map[string]error
+
+func (e StoreErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, e[name].Error())
+	}
+	return "multi store: " + strings.Join(messages, "; ")
 }
 
-type logStore struct{}
+func storeName(store Store, x int) string {
+	switch s := store.(type) {
+	case *namedStore:
+		return s.name
+	case *bestEffortStore:
+		return storeName(s.store, x)
+	case *queueStore:
+		return storeName(s.store, x)
+	}
+	return strconv.Itoa(x)
+}
 
-func (*logStore) Accept(clients []Client, lookups []Lookup) error {
-	var b strings.Builder
-	fmt.Fprintf(&b, "\nACCEPT %d clients, %d lookups\n", len(clients), len(lookups))
-	clientSet := map[string]string{}
-	for _, client := range clients {
-		clientSet[client.IP] = client.Name
+// BestEffort wraps store so that its failures to accept batches are logged
+// rather than returned, and it never holds back readiness.
+func BestEffort(store Store) Store {
+	return &bestEffortStore{store: store}
+}
+
+type bestEffortStore struct {
+	store Store
+}
+
+func (s *bestEffortStore) Accept(ctx context.Context, batch Batch) error {
+	if err := s.store.Accept(ctx, batch); err != nil {
+		logger.Warn("best effort store failed", "store", storeName(s.store, 0), "error", err)
 	}
-	b.WriteString("clients:\n")
-	cx := 0
-	for k, v := range clientSet {
-		fmt.Fprintf(&b, "%5d %30s %-15s\n", cx, k, v)
-		cx++
+	return nil
+}
+
+func (s *bestEffortStore) Close() error { return s.store.Close() }
+
+// NamedStore wraps store so that its Accept duration and errors are reported
+// in the metrics under name.
+func NamedStore(name string, store Store) Store {
+	return &namedStore{name: name, store: store}
+}
+
+type namedStore struct {
+	name  string
+	store Store
+}
+
+func (s *namedStore) Accept(ctx context.Context, batch Batch) error {
+	seconds, errs := metrics.store(s.name)
+	start := time.Now()
+	err := s.store.Accept(ctx, batch)
+	seconds.observe(time.Since(start).Seconds())
+	if err != nil {
+		errs.inc()
+		logger.Error("store Accept failed", "store", s.name, "error", err)
+		return errors.Wrapf(err, "store %s", s.name)
+	}
+	logger.Debug("store Accept", "store", s.name, "clients", len(batch.Clients), "lookups", len(batch.Lookups), "elapsed", time.Since(start))
+	return nil
+}
+
+func (s *namedStore) Close() error {
+	return errors.Wrapf(s.store.Close(), "store %s", s.name)
+}
+
+func (s *namedStore) Healthy(ctx context.Context) error {
+	if checker, ok := s.store.(HealthChecker); ok {
+		return errors.Wrapf(checker.Healthy(ctx), "store %s", s.name)
+	}
+	return nil
+}
+
+func NewLogStore() Store {
+	return &logStore{level: LevelInfo}
+}
+
+// NewLogStoreWithLogger returns a log store writing to l at level rather than
+// to the package logger at info level.
+func NewLogStoreWithLogger(l *Logger, level Level) Store {
+	return &logStore{logger: l, level: level}
+}
+
+type logStore struct {
+	logger *Logger
+	level  Level
+}
+
+func (s *logStore) Accept(_ context.Context, batch Batch) error {
+	l := s.logger
+	if l == nil {
+		l = logger
 	}
-	b.WriteString("lookups:\n")
-	for x, v := range lookups {
-		fmt.Fprintf(&b, "%5d %30s %s\n", x, clientSet[v.Client], v.Host)
+	clientSet := batch.clientNames()
+	l.log(s.level, "accept", []interface{}{"store", "log", "clients", len(clientSet), "lookups", len(batch.Lookups)})
+	for _, lookup := range batch.Lookups {
+		l.log(s.level, "lookup", []interface{}{"store", "log", "when", lookup.When, "client", lookup.Client, "name", clientSet[lookup.Client], "host", lookup.Host})
 	}
-	log.Println(b.String())
 
 	return nil
 }
 
+func (*logStore) Close() error { return nil }
+
 const (
-	insertClients = "insert clients"
-	insertLookups = "insert lookups"
-	insertReverse = "insert reverse"
+	insertHost     = "insert host"
+	selectHost     = "select host"
+	upsertClient   = "upsert client"
+	insertClientIP = "insert client ip"
+	selectClient   = "select client"
+	insertLookup   = "insert lookup"
+	selectLookup   = "select lookup"
+	insertAnswer   = "insert answer"
+	insertReverse  = "insert reverse"
+	upsertPDNS     = "upsert pdns"
+	selectSpan     = "select latest client name"
+	extendSpan     = "extend client name"
+	insertSpan     = "insert client name"
+	upsertHourly   = "upsert hourly rollup"
+	upsertDaily    = "upsert daily rollup"
 )
 
 var (
 	ErrInitializationFailed = errors.New("initialization failed")
 
-	dbPatches = []string{
-		"CREATE TABLE IF NOT EXISTS lookups (evt TEXT NOT NULL, clientip TEXT NOT NULL, host TEXT NOT NULL, PRIMARY KEY(evt, clientip, host) ON CONFLICT REPLACE)",
-		"CREATE TABLE IF NOT EXISTS clients (ip  TEXT NOT NULL, name     TEXT NOT NULL, PRIMARY KEY(ip, name) ON CONFLICT REPLACE)",
-		"CREATE TABLE IF NOT EXISTS reverse (ip  TEXT NOT NULL, name     TEXT NOT NULL, PRIMARY KEY(ip, name) ON CONFLICT REPLACE)",
-	}
-
 	statements = map[string]string{
-		insertClients: "INSERT OR REPLACE INTO clients (ip, name) VALUES (?, ?)",
-		insertLookups: "INSERT OR REPLACE INTO lookups (evt, clientip, host) VALUES (?, ?, ?)",
-		insertReverse: "INSERT OR REPLACE INTO reverse (ip, name) VALUES (?, ?)",
+		insertHost:     "INSERT OR IGNORE INTO hosts (name) VALUES (?)",
+		selectHost:     "SELECT id FROM hosts WHERE name = ?",
+		upsertClient:   "INSERT INTO clients (ip, name) VALUES (?, ?) ON CONFLICT (ip) DO UPDATE SET name = excluded.name",
+		insertClientIP: "INSERT OR IGNORE INTO clients (ip, name) VALUES (?, ?)",
+		selectClient:   "SELECT id FROM clients WHERE ip = ?",
+		insertLookup:   "INSERT OR IGNORE INTO lookups (ts, client_id, host_id, qtype) VALUES (?, ?, ?, ?)",
+		selectLookup:   "SELECT id FROM lookups WHERE ts = ? AND client_id = ? AND host_id = ?",
+		insertAnswer:   "INSERT OR IGNORE INTO answers (lookup_id, ip) VALUES (?, ?)",
+		insertReverse:  "INSERT OR REPLACE INTO reverse (ip, name) VALUES (?, ?)",
+		upsertPDNS: "INSERT INTO pdns (rrname, rrtype, rdata, time_first, time_last, count) VALUES (?, ?, ?, ?, ?, 1) " +
+			"ON CONFLICT (rrname, rrtype, rdata) DO UPDATE SET " +
+			"time_first = min(time_first, excluded.time_first), time_last = max(time_last, excluded.time_last), count = count + 1",
+		selectSpan: "SELECT name, first_seen FROM client_names WHERE ip = ? ORDER BY first_seen DESC LIMIT 1",
+		extendSpan: "UPDATE client_names SET last_seen = max(last_seen, ?) WHERE ip = ? AND first_seen = ?",
+		insertSpan: "INSERT OR IGNORE INTO client_names (ip, name, first_seen, last_seen) VALUES (?, ?, ?, ?)",
+		upsertHourly: "INSERT INTO rollup_hourly (bucket, client_id, host_id, qtype, count) VALUES (?, ?, ?, ?, 1) " +
+			"ON CONFLICT (bucket, client_id, host_id, qtype) DO UPDATE SET count = count + 1",
+		upsertDaily: "INSERT INTO rollup_daily (bucket, client_id, host_id, qtype, count) VALUES (?, ?, ?, ?, 1) " +
+			"ON CONFLICT (bucket, client_id, host_id, qtype) DO UPDATE SET count = count + 1",
 	}
 )
 
-func NewSQLiteStore(path string) Store { return &sqliteStore{db: path} }
+// SQLiteOptions tune the connection held by the sqlite store.
+type SQLiteOptions struct {
+	// JournalMode is applied with PRAGMA journal_mode.
+	JournalMode string
+	// Synchronous is applied with PRAGMA synchronous.
+	Synchronous string
+	// BusyTimeout is how long to wait for a lock held by another connection.
+	BusyTimeout time.Duration
+	// Pragmas are additional "name=value" pragmas applied after opening.
+	Pragmas []string
+	// Partition splits the db into a file per "day", "week" or "month",
+	// if set.
+	Partition string
+}
+
+// sqliteReadConns bounds the connections queries run on concurrently.
+const sqliteReadConns = 4
+
+// DefaultSQLiteOptions let other processes read the db while it is written.
+var DefaultSQLiteOptions = SQLiteOptions{JournalMode: "WAL", Synchronous: "NORMAL", BusyTimeout: 5 * time.Second}
+
+func NewSQLiteStore(path string) Store { return NewSQLiteStoreWithOptions(path, DefaultSQLiteOptions) }
+
+func NewSQLiteStoreWithOptions(path string, opts SQLiteOptions) Store {
+	if opts.Partition != "" {
+		return newPartitionedStore(path, opts)
+	}
+	return &sqliteStore{path: path, opts: opts}
+}
 
 type sqliteStore struct {
-	db    string
-	once  sync.Once
-	valid bool
+	path string
+	opts SQLiteOptions
+
+	mu      sync.Mutex
+	db      *sql.DB
+	stmts   map[string]*sql.Stmt
+	indexed bool
+	// reads are the connections queries run on, so that they do not wait
+	// for batches, nor batches for them, in WAL mode.
+	reads *sql.DB
 }
 
-func (s *sqliteStore) Accept(clients []Client, lookups []Lookup) error {
-	db, err := s.conn()
-	if err != nil {
+func (s *sqliteStore) Accept(ctx context.Context, batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
 		return errors.Wrap(err, "opening connection to sqlite db")
 	}
-	defer db.Close()
 
-	tx, err := db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "beginning transaction")
 	}
-	stmt, err := tx.Prepare(statements[insertClients])
-	if err != nil {
-		return errors.Wrap(err, "preparing insert client statement")
+	if err = s.accept(tx, batch.Clients, batch.Lookups); err != nil {
+		_ = tx.Rollback()
+		return err
 	}
-	cl2 := map[string]string{}
+	return errors.Wrap(tx.Commit(), "committing transaction")
+}
+
+func (s *sqliteStore) accept(tx *sql.Tx, clients []Client, lookups []Lookup) error {
+	t := newSQLiteTx(tx, s.stmts)
+	defer t.close()
+
+	names := map[string]string{}
 	for _, client := range clients {
-		cl2[client.IP] = client.Name
+		names[client.IP] = client.Name
 	}
-	for ip, name := range cl2 {
-		if _, err = stmt.Exec(ip, name); err != nil {
-			_ = stmt.Close()
-			return errors.Wrap(err, "executing statement")
+	for ip, name := range names {
+		if _, err := t.clientID(ip, name); err != nil {
+			return err
 		}
 	}
-	_ = stmt.Close()
 
-	stmt, err = tx.Prepare(statements[insertLookups])
+	for _, lookup := range lookups {
+		clientID, err := t.clientID(lookup.Client, "")
+		if err != nil {
+			return err
+		}
+		hostID, err := t.hostID(lookup.Host)
+		if err != nil {
+			return err
+		}
+		ts := lookup.When.UnixNano()
+		result, err := t.exec(insertLookup, ts, clientID, hostID, lookup.Type)
+		if err != nil {
+			return errors.Wrap(err, "executing insert lookup")
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			// Already recorded, as when NSQ redelivers a message.
+			continue
+		}
+		if _, err = t.exec(upsertHourly, bucket(ts, hour), clientID, hostID, lookup.Type); err != nil {
+			return errors.Wrap(err, "executing upsert hourly rollup")
+		}
+		if _, err = t.exec(upsertDaily, bucket(ts, day), clientID, hostID, lookup.Type); err != nil {
+			return errors.Wrap(err, "executing upsert daily rollup")
+		}
+		var lookupID int64
+		if err = t.stmt(selectLookup).QueryRow(ts, clientID, hostID).Scan(&lookupID); err != nil {
+			return errors.Wrap(err, "selecting lookup")
+		}
+		for _, lip := range lookup.AllIPs {
+			if _, err = t.exec(insertAnswer, lookupID, lip); err != nil {
+				return errors.Wrap(err, "executing insert answer")
+			}
+			if _, err = t.exec(insertReverse, lip, lookup.Host); err != nil {
+				return errors.Wrap(err, "executing insert reverse")
+			}
+		}
+		for _, record := range lookup.records() {
+			if _, err = t.exec(upsertPDNS, record.Name, record.Type, record.Data, ts, ts); err != nil {
+				return errors.Wrap(err, "executing upsert pdns")
+			}
+		}
+	}
+
+	return t.clientNames(names, lookups)
+}
+
+// clientNames extends the current name span of each client seen in lookups,
+// or starts a new span if the client name changed.
+func (t *sqliteTx) clientNames(names map[string]string, lookups []Lookup) error {
+	first, last := map[string]int64{}, map[string]int64{}
+	for _, lookup := range lookups {
+		ts := lookup.When.UnixNano()
+		if f, ok := first[lookup.Client]; !ok || ts < f {
+			first[lookup.Client] = ts
+		}
+		if l, ok := last[lookup.Client]; !ok || ts > l {
+			last[lookup.Client] = ts
+		}
+	}
+
+	for ip, name := range names {
+		if _, ok := first[ip]; !ok {
+			continue
+		}
+		var (
+			current   string
+			firstSeen int64
+		)
+		err := t.stmt(selectSpan).QueryRow(ip).Scan(&current, &firstSeen)
+		switch {
+		case err == nil && current == name:
+			_, err = t.exec(extendSpan, last[ip], ip, firstSeen)
+		case err == nil || err == sql.ErrNoRows:
+			_, err = t.exec(insertSpan, ip, name, first[ip], last[ip])
+		}
+		if err != nil {
+			return errors.Wrap(err, "recording client name")
+		}
+	}
+	return nil
+}
+
+// sqliteTx binds the prepared statements to a transaction as they are needed,
+// and remembers the ids interned during the transaction.
+type sqliteTx struct {
+	tx       *sql.Tx
+	prepared map[string]*sql.Stmt
+	stmts    map[string]*sql.Stmt
+	hosts    map[string]int64
+	clients  map[string]int64
+}
+
+func newSQLiteTx(tx *sql.Tx, prepared map[string]*sql.Stmt) *sqliteTx {
+	return &sqliteTx{
+		tx:       tx,
+		prepared: prepared,
+		stmts:    map[string]*sql.Stmt{},
+		hosts:    map[string]int64{},
+		clients:  map[string]int64{},
+	}
+}
+
+func (t *sqliteTx) stmt(name string) *sql.Stmt {
+	stmt, ok := t.stmts[name]
+	if !ok {
+		stmt = t.tx.Stmt(t.prepared[name])
+		t.stmts[name] = stmt
+	}
+	return stmt
+}
+
+func (t *sqliteTx) exec(name string, args ...interface{}) (sql.Result, error) {
+	return t.stmt(name).Exec(args...)
+}
+
+func (t *sqliteTx) close() {
+	for _, stmt := range t.stmts {
+		_ = stmt.Close()
+	}
+}
+
+func (t *sqliteTx) hostID(name string) (int64, error) {
+	if id, ok := t.hosts[name]; ok {
+		return id, nil
+	}
+	if _, err := t.exec(insertHost, name); err != nil {
+		return 0, errors.Wrap(err, "executing insert host")
+	}
+	var id int64
+	if err := t.stmt(selectHost).QueryRow(name).Scan(&id); err != nil {
+		return 0, errors.Wrap(err, "selecting host")
+	}
+	t.hosts[name] = id
+	return id, nil
+}
+
+// clientID interns ip, renaming the client if name is not empty.
+func (t *sqliteTx) clientID(ip, name string) (int64, error) {
+	if id, ok := t.clients[ip]; ok && name == "" {
+		return id, nil
+	}
+	var err error
+	if name != "" {
+		_, err = t.exec(upsertClient, ip, name)
+	} else {
+		_, err = t.exec(insertClientIP, ip, ip)
+	}
 	if err != nil {
-		return errors.Wrap(err, "preparing insert lookups statement")
+		return 0, errors.Wrap(err, "executing insert client")
+	}
+	var id int64
+	if err = t.stmt(selectClient).QueryRow(ip).Scan(&id); err != nil {
+		return 0, errors.Wrap(err, "selecting client")
+	}
+	t.clients[ip] = id
+	return id, nil
+}
+
+// Close releases the connection to the db.
+func (s *sqliteStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reads != nil {
+		_ = s.reads.Close()
+		s.reads = nil
+	}
+	if s.db == nil {
+		return nil
+	}
+	for _, stmt := range s.stmts {
+		_ = stmt.Close()
 	}
-	revStmt, err := tx.Prepare(statements[insertReverse])
+	err := s.db.Close()
+	s.db, s.stmts = nil, nil
+	return errors.Wrap(err, "closing sqlite db")
+}
+
+// Healthy opens and initializes the db, unless that has been done already.
+func (s *sqliteStore) Healthy(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.open()
+}
+
+// open connects to the db, initializes it and prepares the statements, unless
+// that has been done already.  The caller must hold s.mu.
+func (s *sqliteStore) open() error {
+	if s.db != nil {
+		return nil
+	}
+
+	db, err := openSQLiteDB(s.path, s.opts)
 	if err != nil {
-		return errors.Wrap(err, "preparing insert reverse statement")
+		logger.Error("opening database connection", "store", "sqlite", "db", s.path, "error", err)
+		return errors.Wrap(err, "opening sqlite3 db connection")
 	}
-	ips := 0
-	for _, lookup := range lookups {
-		ips += len(lookup.AllIPs)
-		if _, err = stmt.Exec(lookup.When, lookup.Client, lookup.Host); err != nil {
-			_ = stmt.Close()
-			_ = revStmt.Close()
-			return errors.Wrap(err, "executing insert lookups")
-		}
-		for _, lip := range lookup.AllIPs {
-			if _, err = revStmt.Exec(lip, lookup.Host); err != nil {
+	// A single connection serializes the writes, and keeps the pragmas and
+	// prepared statements alive between batches.
+	db.SetMaxOpenConns(1)
+
+	if err = s.initialize(db); err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	stmts := map[string]*sql.Stmt{}
+	for name, statement := range statements {
+		stmt, err := db.Prepare(statement)
+		if err != nil {
+			for _, stmt := range stmts {
 				_ = stmt.Close()
-				_ = revStmt.Close()
-				return errors.Wrap(err, "executing insert reverse")
 			}
+			_ = db.Close()
+			return errors.Wrapf(err, "preparing %s statement", name)
 		}
+		stmts[name] = stmt
 	}
-	_ = stmt.Close()
-	_ = revStmt.Close()
 
-	return tx.Commit()
+	s.db, s.stmts = db, stmts
+	return nil
 }
 
-func (s *sqliteStore) conn() (*sql.DB, error) {
-	s.check()
-	db, err := sql.Open("sqlite3", s.db)
+// reader returns the connections to query the db on, opening them unless
+// that has been done already.  Reading neither migrates the db nor touches
+// its host index, which belong to the process writing it, so the db must
+// already have the latest schema.
+func (s *sqliteStore) reader() (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reads != nil {
+		return s.reads, nil
+	}
+	reads, err := openSQLiteDB(s.path, s.opts)
 	if err != nil {
-		log.Printf("error opening database connection %q: %v", s.db, err)
 		return nil, errors.Wrap(err, "opening sqlite3 db connection")
 	}
-	s.once.Do(func() { s.initialize(db) })
-	if !s.valid {
-		return nil, ErrInitializationFailed
+	reads.SetMaxOpenConns(sqliteReadConns)
+	err = checkSchema(reads)
+	if err == nil {
+		s.indexed, err = hostIndexed(reads)
 	}
-	return db, nil
+	if err != nil {
+		_ = reads.Close()
+		return nil, err
+	}
+	s.reads = reads
+	return s.reads, nil
 }
 
-func (s *sqliteStore) check() {
-	if _, err := os.Stat(s.db); os.IsNotExist(err) {
-		s.once = sync.Once{}
+// sqliteDSN applies opts to every connection made to path.  Readers need it
+// too: the driver resets the journal mode to DELETE unless told otherwise,
+// which fails with "database is locked" while a WAL db is in use.
+// Transactions take the write lock as they begin, as every transaction nsr
+// runs writes, and one that read first could not upgrade its lock while
+// another process writes.
+func sqliteDSN(path string, opts SQLiteOptions) string {
+	params := url.Values{"_txlock": {"immediate"}}
+	if opts.JournalMode != "" {
+		params.Set("_journal_mode", opts.JournalMode)
+	}
+	if opts.Synchronous != "" {
+		params.Set("_synchronous", opts.Synchronous)
 	}
+	if opts.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(int64(opts.BusyTimeout/time.Millisecond), 10))
+	}
+	return path + "?" + params.Encode()
+}
+
+// openSQLiteDB opens the db at path with the driver applying the pragmas of
+// opts.
+func openSQLiteDB(path string, opts SQLiteOptions) (*sql.DB, error) {
+	name, _ := sqliteDriver(opts.Pragmas)
+	return sql.Open(name, sqliteDSN(path, opts))
 }
 
-func (s *sqliteStore) initialize(db *sql.DB) (err error) {
-	for x, dbPatch := range dbPatches {
-		if _, err = db.Exec(dbPatch); err != nil {
-			log.Printf("error applying database patch %d: %v", x, err)
-			return
+var sqliteDrivers = struct {
+	sync.Mutex
+	names   map[string]string
+	drivers map[string]*sqlite3.SQLiteDriver
+}{names: map[string]string{}, drivers: map[string]*sqlite3.SQLiteDriver{}}
+
+// sqliteDriver returns the name of a driver applying pragmas to every
+// connection it makes, and the driver: database/sql may replace a connection
+// at any time, and the new one needs them too.  A driver is registered once
+// for every set of pragmas.
+func sqliteDriver(pragmas []string) (string, *sqlite3.SQLiteDriver) {
+	if len(pragmas) == 0 {
+		return "sqlite3", &sqlite3.SQLiteDriver{}
+	}
+	key := strings.Join(pragmas, "\n")
+
+	sqliteDrivers.Lock()
+	defer sqliteDrivers.Unlock()
+	if name, ok := sqliteDrivers.names[key]; ok {
+		return name, sqliteDrivers.drivers[key]
+	}
+	pragmas = append([]string(nil), pragmas...)
+	driver := &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		for _, pragma := range pragmas {
+			if _, err := conn.Exec("PRAGMA "+pragma, nil); err != nil {
+				logger.Error("applying pragma", "store", "sqlite", "pragma", pragma, "error", err)
+				return errors.Wrapf(ErrInitializationFailed, "applying pragma %s: %v", pragma, err)
+			}
 		}
+		return nil
+	}}
+	name := fmt.Sprintf("sqlite3-nsr-%d", len(sqliteDrivers.names)+1)
+	sql.Register(name, driver)
+	sqliteDrivers.names[key], sqliteDrivers.drivers[key] = name, driver
+	return name, driver
+}
+
+func (s *sqliteStore) initialize(db *sql.DB) error {
+	if _, err := migrate(db); err != nil {
+		logger.Error("migrating schema", "store", "sqlite", "db", s.path, "error", err)
+		return errors.Wrapf(ErrInitializationFailed, "migrating schema: %v", err)
 	}
-	s.valid = true
-	return
+	indexed, err := hostIndex(db)
+	if err != nil {
+		logger.Error("creating host search index", "store", "sqlite", "db", s.path, "error", err)
+		return errors.Wrapf(ErrInitializationFailed, "creating host search index: %v", err)
+	}
+	s.indexed = indexed
+	return nil
 }
@@ -0,0 +1,66 @@
+package nsrecorder
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogStoreLevel(t *testing.T) {
+	var buf bytes.Buffer
+	store := NewLogStoreWithLogger(NewLogger(&buf, LevelWarn, false), LevelWarn)
+	if err := store.Accept(context.Background(), memoryBatch("example.com")); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, want the batch and its lookup", buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "level=warn") {
+			t.Errorf("logged %q, want level=warn", line)
+		}
+	}
+}
+
+func TestSQLiteReadDoesNotMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nsr.db")
+	if err = ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewSQLiteStore(path)
+	defer store.Close()
+	if _, err = store.(Reader).LookupsByHost(context.Background(), "example.com", Query{}); err == nil {
+		t.Error("no error reading a db without schema")
+	}
+	if _, err = store.(Reader).SearchHosts(context.Background(), "example", Query{}); err == nil {
+		t.Error("no error searching a db without schema")
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var version, objects int
+	if err = db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("SELECT count(*) FROM sqlite_master").Scan(&objects); err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || objects != 0 {
+		t.Errorf("reading left schema version %d and %d objects, want none", version, objects)
+	}
+}
@@ -3,19 +3,31 @@ package nsrecorder // import "jw4.us/nsrecorder"
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	nsq "github.com/nsqio/go-nsq"
 	"github.com/pkg/errors"
 )
 
+// maxInFlight is the number of messages nsqd sends before the first of them
+// is finished or requeued.  A batch is stored once it holds that many, as
+// no more arrive until it is.
+const maxInFlight = 100
+
 func NewWatcher(ctx context.Context, store Store) *Watcher {
-	w := &Watcher{ctx: ctx, store: store, msg: make(chan *nsq.Message)}
+	w := &Watcher{
+		ctx:         ctx,
+		store:       store,
+		msg:         make(chan *nsq.Message),
+		staleAfter:  defaultStaleAfter,
+		maxFailures: defaultMaxFailures,
+		lastFlush:   time.Now(),
+		stopped:     make(chan struct{}),
+	}
 	w.start()
 	return w
 }
@@ -25,16 +37,38 @@ type Watcher struct {
 	store    Store
 	msg      chan *nsq.Message
 	consumer *nsq.Consumer
+	logger   *Logger
+	batch    uint64
+	stopped  chan struct{}
+
+	staleAfter  time.Duration
+	maxFailures int
+	// pseudonymize keeps message bodies, which hold the real client ips,
+	// out of the log.
+	pseudonymize bool
+
+	mu           sync.Mutex
+	lastReceived time.Time
+	lastFlush    time.Time
+	failures     int
 }
 
+// HandleMessage queues message for the next batch, which finishes or
+// requeues it once it is stored.
 func (w *Watcher) HandleMessage(message *nsq.Message) error {
+	message.DisableAutoResponse()
 	message.Touch()
+	metrics.received.inc()
+	w.received()
 	w.log(message)
 	return nil
 }
 
+// Stop waits until w has stopped after its context was done: the consumer
+// has stopped, the messages received by then are stored, and the store is
+// closed.
 func (w *Watcher) Stop() {
-	<-w.consumer.StopChan
+	<-w.stopped
 }
 
 func (w *Watcher) start() {
@@ -53,16 +87,29 @@ func (w *Watcher) start() {
 		panic("no lookupd")
 	}
 
+	if staleAfter, ok := w.ctx.Value("staleAfter").(time.Duration); ok && staleAfter > 0 {
+		w.staleAfter = staleAfter
+	}
+
+	if maxFailures, ok := w.ctx.Value("maxFailures").(int); ok && maxFailures > 0 {
+		w.maxFailures = maxFailures
+	}
+
+	w.pseudonymize, _ = w.ctx.Value("pseudonymize").(bool)
+
+	w.logger = logger.With("topic", topic, "channel", channel)
+
 	config := nsq.NewConfig()
 	config.ClientID = "nsr"
 	config.Hostname, _ = os.Hostname()
 	config.UserAgent = "nsr go client"
-	config.MaxInFlight = 10
+	config.MaxInFlight = maxInFlight
 
 	var err error
 	if w.consumer, err = nsq.NewConsumer(topic, channel, config); err != nil {
 		panic(err)
 	}
+	w.consumer.SetLogger(w.logger, w.logger.NSQLogLevel())
 	w.consumer.AddConcurrentHandlers(w, 10)
 	go w.loop()
 	if err = w.consumer.ConnectToNSQLookupds(lookupd); err != nil {
@@ -77,42 +124,107 @@ func (w *Watcher) loop() {
 		select {
 		case msg := <-w.msg:
 			messages = append(messages, msg)
+			if len(messages) >= maxInFlight {
+				w.handleBatch(messages)
+				messages = []*nsq.Message{}
+			}
 		case <-after:
 			if len(messages) > 0 {
 				w.handleBatch(messages)
 				messages = []*nsq.Message{}
 			}
 		case <-w.ctx.Done():
-			w.consumer.Stop()
+			w.shutdown(messages)
 			return
 		}
 	}
 }
 
+// shutdown stops the consumer, stores the messages received until it has
+// stopped, and closes the store.  The consumer only stops once no message is
+// in flight, so every message received is stored, and finished or requeued,
+// as soon as there is no other to batch it with.
+func (w *Watcher) shutdown(messages []*nsq.Message) {
+	defer close(w.stopped)
+
+	w.consumer.Stop()
+	for stopping := true; stopping; {
+		for received := true; received; {
+			select {
+			case msg := <-w.msg:
+				messages = append(messages, msg)
+			default:
+				received = false
+			}
+		}
+		if len(messages) > 0 {
+			w.handleBatch(messages)
+			messages = nil
+		}
+		select {
+		case msg := <-w.msg:
+			messages = append(messages, msg)
+		case <-w.consumer.StopChan:
+			stopping = false
+		}
+	}
+	if err := w.store.Close(); err != nil {
+		w.logger.Error("closing store", "error", err)
+	}
+	w.logger.Info("stopped")
+}
+
 func (w *Watcher) handleBatch(messages []*nsq.Message) {
-	fmt.Printf("Processing: %v\n", time.Now())
+	w.batch++
+	batchLog := w.logger.With("batch", w.batch)
+	batchLog.Info("processing batch", "messages", len(messages))
+	start := time.Now()
+	metrics.batchSize.observe(float64(len(messages)))
+	parsed := []*nsq.Message{}
 	clients := []Client{}
 	lookups := []Lookup{}
 	for _, msg := range messages {
 		c, l, err := parse(msg)
 		if err != nil {
-			log.Printf("error in parse: %v", err)
+			batchLog.Warn("requeueing unparseable message", "message_id", string(msg.ID[:]), "error", err)
+			if !w.pseudonymize {
+				batchLog.Debug("unparseable message", "message_id", string(msg.ID[:]), "body", string(msg.Body))
+			}
+			metrics.parseErrors.inc()
+			metrics.requeued.inc()
 			msg.Requeue(-1)
 			continue
 		}
+		parsed = append(parsed, msg)
 		clients = append(clients, c)
 		lookups = append(lookups, l)
 	}
-	err := w.store.Accept(clients, lookups)
-	for _, msg := range messages {
-		switch err {
-		case nil:
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	err := w.store.Accept(ctx, Batch{Clients: clients, Lookups: lookups})
+	cancel()
+	// A journaled batch counts as a failure of the store, but its messages
+	// are finished: the journal replays it.
+	journaled := Journaled(err)
+	switch {
+	case journaled:
+		batchLog.Warn("finishing journaled batch", "messages", len(parsed), "error", err)
+	case err != nil:
+		batchLog.Error("requeueing batch", "messages", len(parsed), "error", err)
+	}
+	w.flushed(err)
+	for _, msg := range parsed {
+		switch {
+		case err == nil, journaled:
+			metrics.finished.inc()
 			msg.Finish()
 		default:
-			log.Printf("error in store.Accept: %v", err)
+			metrics.requeued.inc()
 			msg.Requeue(-1)
 		}
 	}
+	elapsed := time.Since(start)
+	metrics.flushSeconds.observe(elapsed.Seconds())
+	batchLog.Debug("processed batch", "elapsed", elapsed)
 }
 
 func (w *Watcher) log(message *nsq.Message) {
@@ -125,34 +237,37 @@ func parse(rawmsg *nsq.Message) (Client, Lookup, error) {
 		lookup Lookup
 		err    error
 
-		hosts, qhosts, aips []string
+		qhosts, qtypes, aips []string
 	)
 
 	msg := Message{}
 	if err = json.Unmarshal(rawmsg.Body, &msg); err != nil {
-		log.Printf("unmarshaling nsq message: %v\n%s", err, rawmsg.Body)
 		return client, lookup, errors.Wrap(err, "unmarshaling nsq.Message")
 	}
 
 	client.IP = msg.ClientIP
-	client.Name = msg.ClientIP
-	if hosts, err = net.LookupAddr(msg.ClientIP); err == nil {
-		client.Name = hosts[0]
-	}
+	client.Name = reverse.lookup(msg.ClientIP)
 
 	lookup.When = msg.Time
 	lookup.Client = msg.ClientIP
 	for _, q := range msg.Msg.Question {
 		qhosts = append(qhosts, q.Name)
+		qtypes = append(qtypes, typeName(q.Qtype))
 	}
 	lookup.Host = strings.Join(qhosts, ",")
+	lookup.Type = strings.Join(qtypes, ",")
 
 	for _, a := range msg.Msg.Answer {
 		if a.A != "" {
 			aips = append(aips, a.A)
+			lookup.Answers = append(lookup.Answers, Record{Name: a.Hdr.Name, Type: "A", Data: a.A})
 		}
 		if a.AAAA != "" {
 			aips = append(aips, a.AAAA)
+			lookup.Answers = append(lookup.Answers, Record{Name: a.Hdr.Name, Type: "AAAA", Data: a.AAAA})
+		}
+		if a.Target != "" {
+			lookup.Answers = append(lookup.Answers, Record{Name: a.Hdr.Name, Type: "CNAME", Data: a.Target})
 		}
 	}
 	if len(aips) > 0 {
@@ -162,3 +277,66 @@ func parse(rawmsg *nsq.Message) (Client, Lookup, error) {
 	}
 	return client, lookup, nil
 }
+
+const (
+	reverseTTL = 10 * time.Minute
+	// reverseMaxNames caps the cached names, so that churning or spoofed
+	// client ips can not grow the cache without bound.
+	reverseMaxNames = 10000
+)
+
+var reverse = &reverseCache{names: map[string]reverseName{}}
+
+// reverseCache remembers client names so that every message does not cost a
+// reverse DNS lookup.
+type reverseCache struct {
+	mu        sync.Mutex
+	names     map[string]reverseName
+	lastSweep time.Time
+}
+
+type reverseName struct {
+	name    string
+	expires time.Time
+}
+
+func (c *reverseCache) lookup(ip string) string {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.names[ip]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		metrics.reverseHits.inc()
+		return cached.name
+	}
+	metrics.reverseMisses.inc()
+
+	name := ip
+	if hosts, err := net.LookupAddr(ip); err == nil && len(hosts) > 0 {
+		name = hosts[0]
+	}
+	c.mu.Lock()
+	c.evict(now)
+	c.names[ip] = reverseName{name: name, expires: now.Add(reverseTTL)}
+	c.mu.Unlock()
+	return name
+}
+
+// evict deletes the expired names once every reverseTTL, and arbitrary ones
+// while the cache is full.  The caller must hold c.mu.
+func (c *reverseCache) evict(now time.Time) {
+	if now.Sub(c.lastSweep) >= reverseTTL {
+		for ip, cached := range c.names {
+			if !now.Before(cached.expires) {
+				delete(c.names, ip)
+			}
+		}
+		c.lastSweep = now
+	}
+	for ip := range c.names {
+		if len(c.names) < reverseMaxNames {
+			break
+		}
+		delete(c.names, ip)
+	}
+}
@@ -0,0 +1,136 @@
+package nsrecorder // import "jw4.us/nsrecorder"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureHeader holds the hex HMAC-SHA256 of a webhook request body, as
+// sent, keyed with WebhookOptions.Secret and prefixed with "sha256=".
+const SignatureHeader = "X-Nsr-Signature"
+
+// WebhookOptions configure a webhook store.
+type WebhookOptions struct {
+	// Timeout bounds each request.
+	Timeout time.Duration
+	// Retries is the number of times a failed request is retried.
+	Retries int
+	// Backoff is the delay before the first retry, doubled for each
+	// following one.
+	Backoff time.Duration
+	// Header is added to every request.
+	Header http.Header
+	// Secret signs request bodies if set.
+	Secret []byte
+	// Gzip compresses request bodies.
+	Gzip bool
+}
+
+// DefaultWebhookOptions are used by NewWebhookStore.
+var DefaultWebhookOptions = WebhookOptions{Timeout: 10 * time.Second, Retries: 3, Backoff: time.Second}
+
+// NewWebhookStore returns a Store POSTing every batch it accepts to url as a
+// JSON object with clients and lookups.
+func NewWebhookStore(url string) Store {
+	return NewWebhookStoreWithOptions(url, DefaultWebhookOptions)
+}
+
+// NewWebhookStoreWithOptions returns a webhook store configured by opts.
+// Requests failing with a network error, a 429 or a 5xx status are retried.
+func NewWebhookStoreWithOptions(url string, opts WebhookOptions) Store {
+	return &webhookStore{url: url, opts: opts, client: &http.Client{Timeout: opts.Timeout}}
+}
+
+type webhookStore struct {
+	url    string
+	opts   WebhookOptions
+	client *http.Client
+}
+
+func (s *webhookStore) Accept(ctx context.Context, batch Batch) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return errors.Wrap(err, "marshaling webhook body")
+	}
+	if s.opts.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err = zw.Write(body); err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return errors.Wrap(err, "compressing webhook body")
+		}
+		body = buf.Bytes()
+	}
+
+	backoff := s.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= s.opts.Retries {
+			return errors.Wrapf(err, "posting to webhook after %d attempts", attempt+1)
+		}
+		logger.Warn("retrying webhook", "store", "webhook", "attempt", attempt+1, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Wrapf(err, "posting to webhook: %v", ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+func (s *webhookStore) Close() error { return nil }
+
+// post sends body once, and says whether a failure is worth retrying.
+func (s *webhookStore) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "creating webhook request")
+	}
+	req = req.WithContext(ctx)
+	for name, values := range s.opts.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nsr/"+Version)
+	if s.opts.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if len(s.opts.Secret) > 0 {
+		mac := hmac.New(sha256.New, s.opts.Secret)
+		_, _ = mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The URL may hold a token, so it is left out of the error.
+		if uerr, ok := err.(*url.Error); ok {
+			err = errors.Wrap(uerr.Err, "posting webhook")
+		}
+		return true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, errors.Errorf("webhook responded %s", resp.Status)
+}
@@ -0,0 +1,165 @@
+package nsrecorder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var webhookBatch = Batch{
+	Clients: []Client{{IP: "10.0.0.1", Name: "laptop"}},
+	Lookups: []Lookup{{When: time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC), Client: "10.0.0.1", Host: "example.com", Type: "A"}},
+}
+
+// statusServer responds to every request with the next of statuses, the
+// last one repeating, and counts the requests.
+func statusServer(statuses ...int) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+	}))
+	return server, &requests
+}
+
+func TestWebhookSignedGzip(t *testing.T) {
+	secret := []byte("secret")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if got, want := r.Header.Get(SignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+		}
+		if got := r.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("Content-Encoding %q, want gzip", got)
+		}
+		if got := r.Header.Get("X-Token"); got != "token" {
+			t.Errorf("X-Token %q, want token", got)
+		}
+
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		batch := Batch{}
+		if err = json.NewDecoder(zr).Decode(&batch); err != nil {
+			t.Error(err)
+			return
+		}
+		if len(batch.Lookups) != 1 || batch.Lookups[0].Host != "example.com" || len(batch.Clients) != 1 {
+			t.Errorf("received %+v", batch)
+		}
+	}))
+	defer server.Close()
+
+	opts := DefaultWebhookOptions
+	opts.Secret, opts.Gzip = secret, true
+	opts.Header = http.Header{"X-Token": {"token"}}
+	if err := NewWebhookStoreWithOptions(server.URL, opts).Accept(context.Background(), webhookBatch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		requests int32
+		fails    bool
+	}{
+		{"succeeds after 5xx", []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK}, 3, false},
+		{"succeeds after 429", []int{http.StatusTooManyRequests, http.StatusNoContent}, 2, false},
+		{"gives up", []int{http.StatusBadGateway}, 3, true},
+		{"does not retry 4xx", []int{http.StatusBadRequest}, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, requests := statusServer(tc.statuses...)
+			defer server.Close()
+
+			opts := WebhookOptions{Timeout: time.Second, Retries: 2, Backoff: 10 * time.Millisecond}
+			start := time.Now()
+			err := NewWebhookStoreWithOptions(server.URL, opts).Accept(context.Background(), webhookBatch)
+			if (err != nil) != tc.fails {
+				t.Errorf("error %v, want failure %v", err, tc.fails)
+			}
+			if n := atomic.LoadInt32(requests); n != tc.requests {
+				t.Errorf("%d requests, want %d", n, tc.requests)
+			}
+			// The backoff doubles: 10ms before the first retry, 20ms
+			// before the second.
+			var backoff time.Duration
+			for x := int32(1); x < tc.requests; x++ {
+				backoff += opts.Backoff << uint(x-1)
+			}
+			if elapsed := time.Since(start); elapsed < backoff {
+				t.Errorf("took %s, want at least %s of backoff", elapsed, backoff)
+			}
+		})
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	opts := WebhookOptions{Timeout: 20 * time.Millisecond}
+	start := time.Now()
+	err := NewWebhookStoreWithOptions(server.URL+"/hooks/token", opts).Accept(context.Background(), webhookBatch)
+	if err == nil {
+		t.Error("no error from a webhook that does not respond")
+	} else if strings.Contains(err.Error(), "token") {
+		t.Errorf("error %q reveals the webhook URL", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s to time out", elapsed)
+	}
+}
+
+func TestWebhookCanceled(t *testing.T) {
+	server, requests := statusServer(http.StatusServiceUnavailable)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := WebhookOptions{Timeout: time.Second, Retries: 5, Backoff: time.Hour}
+	done := make(chan error, 1)
+	go func() { done <- NewWebhookStoreWithOptions(server.URL, opts).Accept(ctx, webhookBatch) }()
+	for atomic.LoadInt32(requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("no error from a canceled webhook")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("canceling did not stop the retries")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+}